@@ -3,6 +3,8 @@ package common
 import (
 	"github.com/golang/glog"
 	"sync"
+	"sync/atomic"
+	"time"
 	"xconn/tools"
 )
 
@@ -13,14 +15,27 @@ type BaseConn struct {
 	Id            string               // id
 	RemoteAddress string               // 地址
 	LocalAddr     string               // 本地地址
-	Sender        *tools.DataTransport // 发送队列
+	Sender        *tools.PriorityTransport // 发送队列，按优先级分通道
 	TimeoutCheck  *tools.TimeoutCheck  // 超时检测
 	Done          chan bool            // 标识是否完成
+	FinishHook    func()               // 结束通知，不为nil时Finish调用该函数而不是写入Done
 	RecvBufSize   int                  // 接收缓冲区大小
+	RecvBufMaxSize int                 // 接收缓冲区最大值
+	RecvBufLockFree bool               // 接收缓冲区是否使用无锁实现
 	ConnCallback  ConnCallback         // 服务端
 	DataHandler DataHandler        // 包解析器
 	Label         string               // 标签
 	Tag           sync.Map             // 自定义数据
+	Receiver      *tools.TaskQueue     // 接收队列，为nil时在接收协程中直接处理
+	RecvFullPolicy string              // 接收队列已满时的处理策略
+	Heartbeat     HeartbeatProvider    // 主动心跳
+	HeartbeatInterval time.Duration    // 主动心跳间隔
+	lastPingTime  int64                // 最后一次发送心跳的时间，UnixNano，原子操作
+	rtt           int64                // 最近一次心跳往返时间，原子操作
+	heartbeatTimer *tools.Timer        // 主动心跳定时任务
+	heartbeatMu   sync.Mutex           // 心跳定时任务锁，与Close互斥
+	closed        bool                 // 是否已关闭，heartbeatMu保护
+	closeOnce     sync.Once
 	IConn         IConn
 }
 
@@ -32,17 +47,92 @@ func (cl *BaseConn)GetId()string{
 }
 
 func (cl *BaseConn)Send(data []byte){
+	cl.SendPriority(data, PriorityNormal)
+}
+
+/**
+ * @brief: 按优先级发送
+ * @param1 data: 数据
+ * @param2 level: 优先级，PriorityHigh、PriorityNormal、PriorityBulk
+ */
+func (cl *BaseConn)SendPriority(data []byte, level int){
 	if data == nil{
 		glog.Errorln("发送数据位nil")
 		return
 	}
 
-	cl.Sender.Produce(data)
+	cl.Sender.Produce(data, level)
+}
+
+/**
+ * @brief: 按配置创建发送队列
+ */
+func NewSender(config *Config)*tools.PriorityTransport{
+	high := config.SendHighChanSize
+	if high <= 0 {
+		high = config.SendChanSize
+	}
+	bulk := config.SendBulkChanSize
+	if bulk <= 0 {
+		bulk = config.SendChanSize
+	}
+	return tools.NewPriorityTransport([]int{high, config.SendChanSize, bulk}, config.SendStarveLimit)
 }
 
 func (cl *BaseConn)Close(){
-	cl.TimeoutCheck.Cancel()
-	cl.Sender.Cancel()
+	cl.closeOnce.Do(func() {
+		cl.TimeoutCheck.Cancel()
+		cl.Sender.Cancel()
+		if cl.Receiver != nil {
+			cl.Receiver.Close()
+		}
+		cl.heartbeatMu.Lock()
+		cl.closed = true
+		if cl.heartbeatTimer != nil {
+			cl.heartbeatTimer.Stop()
+			cl.heartbeatTimer = nil
+		}
+		cl.heartbeatMu.Unlock()
+	})
+}
+
+/**
+ * @brief: 接收数据放入接收队列，由工作协程池处理
+ * @param1 item: 接收数据，所有权转交给接收队列；为[]byte时是池化的数据，处理完成或者丢弃后归还字节池
+ * @return1: false表示队列已满且策略为关闭连接
+ */
+func (cl *BaseConn)PushRecv(item interface{})bool{
+	block := cl.RecvFullPolicy != RecvFullDrop && cl.RecvFullPolicy != RecvFullClose
+	if cl.Receiver.Push(item, block) {
+		return true
+	}
+
+	if data, ok := item.([]byte); ok {
+		tools.PutBytes(data)
+	}
+	if cl.RecvFullPolicy == RecvFullClose {
+		glog.Errorln(cl.Label, cl.IConn.GetRemoteAddr(), "接收队列已满，关闭连接")
+		return false
+	}
+	if cl.RecvFullPolicy == RecvFullDrop {
+		glog.Warningln(cl.Label, cl.IConn.GetRemoteAddr(), "接收队列已满，丢弃数据")
+	}
+	return true
+}
+
+/**
+ * @brief: 通知连接结束，已有结束通知时直接返回
+ */
+func (cl *BaseConn)Finish(){
+	if cl.FinishHook != nil {
+		cl.FinishHook()
+		return
+	}
+
+	select {
+	case cl.Done <- true:
+	default:
+	}
 }
 
 func (cl *BaseConn)GetTag(key string)interface{}{
@@ -83,12 +173,91 @@ func (cl *BaseConn)GetLocalAddr()string{
 }
 
 /**
- * @brief: 超时检测进程
+ * 获取最近一次心跳往返时间，未收到过心跳回复时为0
+ */
+func (cl *BaseConn)GetRTT()time.Duration{
+	return time.Duration(atomic.LoadInt64(&cl.rtt))
+}
+
+/**
+ * @brief: 收到心跳回复，根据最后一次发送心跳的时间计算往返时间
+ * DataHandler自行解析出心跳回复时（例如tcp拆包后）也可以直接调用
+ */
+func (cl *BaseConn)OnPong(){
+	sent := atomic.SwapInt64(&cl.lastPingTime, 0)
+	if sent == 0 {
+		return
+	}
+	atomic.StoreInt64(&cl.rtt, time.Now().UnixNano() - sent)
+}
+
+/**
+ * @brief: 检查接收到的数据是否为心跳回复
+ * @param1 data: 接收到的数据
+ */
+func (cl *BaseConn)MatchPong(data []byte){
+	if cl.Heartbeat == nil {
+		return
+	}
+	if m, ok := cl.Heartbeat.(HeartbeatMatcher); ok && m.IsPong(data, cl.IConn) {
+		cl.OnPong()
+	}
+}
+
+/**
+ * @brief: 主动心跳，在共享时间轮上每个HeartbeatInterval发送一次心跳包
+ * 已经Close（例如在OnConnected中拒绝连接）时不再启动
+ */
+func (cl *BaseConn)StartHeartbeatProcess(){
+	if cl.Heartbeat == nil || cl.HeartbeatInterval <= 0 {
+		return
+	}
+
+	cl.heartbeatMu.Lock()
+	defer cl.heartbeatMu.Unlock()
+	if cl.closed {
+		return
+	}
+	cl.heartbeatTimer = tools.DefaultTimingWheel().Every(cl.HeartbeatInterval, func() {
+		// 发送可能阻塞，不占用时间轮协程
+		go cl.sendPing()
+	})
+}
+
+/**
+ * @brief: 发送一次心跳包
+ */
+func (cl *BaseConn)sendPing(){
+	atomic.StoreInt64(&cl.lastPingTime, time.Now().UnixNano())
+	if data := cl.Heartbeat.Ping(cl.IConn); data != nil {
+		cl.IConn.SendPriority(data, PriorityHigh)
+	}
+}
+
+/**
+ * @brief: 超时检测，空闲事件交给ConnCallback的OnIdle处理，在时间轮协程中回调，不能阻塞
+ * ConnCallback为服务端，由服务端决定交给应用处理还是关闭连接
  */
 func (cl *BaseConn)StartTimeoutCheckProcess() {
-	cl.TimeoutCheck.Check(func(b bool) {
-		if b {
-			cl.Done <- true
-		}
+	h, ok := cl.ConnCallback.(IdleHandler)
+	if !ok {
+		return
+	}
+	cl.TimeoutCheck.CheckIdle(func(kind int) bool {
+		h.OnIdle(cl.IConn, kind)
+		return true
 	})
 }
+
+/**
+ * @brief: 按配置创建空闲检测
+ */
+func NewTimeoutCheck(config *Config)*tools.TimeoutCheck{
+	reader := config.ReaderIdle
+	if reader <= 0 {
+		reader = config.Timeout
+	}
+	tc := tools.NewTimeoutCheck(config.Interval, reader)
+	tc.SetIdle(config.WriterIdle, config.AllIdle)
+	return tc
+}
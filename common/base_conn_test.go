@@ -0,0 +1,63 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+type countPing struct{ n chan struct{} }
+
+func (p countPing) Ping(conn IConn) []byte {
+	p.n <- struct{}{}
+	return nil
+}
+
+func newTestConn(interval time.Duration) (*BaseConn, countPing) {
+	config := &Config{Interval: interval}
+	p := countPing{n: make(chan struct{}, 16)}
+	cl := &BaseConn{
+		Sender:            NewSender(config),
+		TimeoutCheck:      NewTimeoutCheck(config),
+		Heartbeat:         p,
+		HeartbeatInterval: interval,
+	}
+	return cl, p
+}
+
+// Close in OnConnected runs before StartHeartbeatProcess, the heartbeat must not start afterwards
+func TestHeartbeatNotStartedAfterClose(t *testing.T) {
+	cl, p := newTestConn(20 * time.Millisecond)
+	cl.Close()
+	cl.StartHeartbeatProcess()
+
+	select {
+	case <-p.n:
+		t.Fatal("heartbeat sent after Close")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if cl.heartbeatTimer != nil {
+		t.Fatal("heartbeat timer started after Close")
+	}
+}
+
+func TestHeartbeatStoppedByClose(t *testing.T) {
+	cl, p := newTestConn(20 * time.Millisecond)
+	cl.StartHeartbeatProcess()
+
+	select {
+	case <-p.n:
+	case <-time.After(time.Second):
+		t.Fatal("no heartbeat")
+	}
+	cl.Close()
+	// a ping already fired may still be delivered
+	time.Sleep(50 * time.Millisecond)
+	for len(p.n) > 0 {
+		<-p.n
+	}
+	select {
+	case <-p.n:
+		t.Fatal("heartbeat sent after Close")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
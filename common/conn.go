@@ -2,7 +2,11 @@ package common
 
 import (
 	"github.com/gin-gonic/gin"
+	"io"
+	"net"
+	"net/http"
 	"time"
+	"xconn/tools"
 )
 
 ///**
@@ -22,16 +26,62 @@ import (
 
 /**
  * 数据包处理接口
+ *
+ * 数据所有权约定：
+ * 传入Handle的数据直接引用连接的接收缓冲区（tcp为接收ringBuf，udp为池化的数据报缓冲区），
+ * 仅在本次Handle调用期间有效，Handle返回后缓冲区会被复用。
+ * 对其拆分得到的子切片同样如此，需要在Handle返回后继续持有（例如放入其他协程的队列）时，必须先拷贝一份。
+ * Config.WorkerCount>0时Handle在工作协程池中调用，同一连接的数据按接收顺序串行处理，不同连接之间并行处理。
  */
 type DataHandler interface {
 	/**
 	 * @brief: 数据包处理接口
-	 * @param1: 数据包
+	 * @param1: 数据包，仅在本次调用期间有效
 	 * @param2: 当前连接
+	 * @return1: 未处理完的剩余数据，必须是传入数据的尾部（通常直接返回其子切片），连接会保留这部分数据等待后续拼接
+	 * @return2: 错误信息，不为nil时丢弃本次所有数据
 	 */
 	Handle([]byte, IConn)([]byte, error)
 }
 
+/**
+ * websocket消息类型，与RFC 6455的操作码相同
+ */
+const (
+	WsTextMessage   = 1 // 文本消息
+	WsBinaryMessage = 2 // 二进制消息
+)
+
+/**
+ * websocket消息处理接口，DataHandler可选实现
+ * 实现后ws连接收到的消息交给HandleMessage而不是Handle，可以区分文本、二进制消息；数据所有权约定与Handle相同
+ */
+type WsMessageHandler interface {
+	/**
+	 * @brief: 消息处理接口
+	 * @param1 msgType: 消息类型，WsTextMessage或者WsBinaryMessage
+	 * @param2 data: 消息数据
+	 * @param3 conn: 当前连接
+	 */
+	HandleMessage(msgType int, data []byte, conn IConn)
+}
+
+/**
+ * websocket流式消息处理接口，DataHandler可选实现，优先于WsMessageHandler
+ * 实现后每个消息以io.Reader交给HandleStream，不在内存中缓存整个消息，适合上传大文件、图片；
+ * 在接收协程中直接调用（不使用工作协程池），返回前读取下一个消息会被阻塞，不经过HeartbeatMatcher检查
+ */
+type WsStreamHandler interface {
+	/**
+	 * @brief: 流式消息处理接口
+	 * @param1 msgType: 消息类型，WsTextMessage或者WsBinaryMessage
+	 * @param2 r: 消息内容，只在本次调用期间有效，未读完的部分会被丢弃；超过WsReadLimit时返回错误并以1009关闭连接
+	 * @param3 conn: 当前连接
+	 * @return1: 错误信息，不为nil时回调OnError，连接继续
+	 */
+	HandleStream(msgType int, r io.Reader, conn IConn)error
+}
+
 /**
  * 连接回调接口
  */
@@ -55,23 +105,198 @@ type ConnCallback interface {
 	OnError(conn IConn, err error)
 }
 
+/**
+ * 接收队列已满时的处理策略
+ */
+const (
+	RecvFullBlock = "block" // 阻塞接收协程直到队列有空间，udp所有连接共用一个接收协程，会相互影响
+	RecvFullDrop  = "drop"  // 丢弃新收到的数据，tcp为流数据，丢弃会破坏拆包，按RecvFullClose处理
+	RecvFullClose = "close" // 关闭连接
+)
+
+/**
+ * 空闲类型
+ */
+const (
+	IdleReader = tools.IdleReader // 读空闲
+	IdleWriter = tools.IdleWriter // 写空闲
+	IdleAll    = tools.IdleAll    // 读写空闲
+)
+
+/**
+ * 空闲回调接口，ConnCallback可选实现
+ * 实现后空闲事件都交给OnIdle，由应用决定发送探测包、记录日志或者关闭连接（调用conn.Close()）；
+ * 未实现时读空闲直接关闭连接
+ */
+type IdleHandler interface {
+	/**
+	 * @brief: 空闲回调，空闲持续期间每经过一个对应空闲时间回调一次
+	 * @param1 conn: 连接
+	 * @param2 kind: 空闲类型，IdleReader、IdleWriter、IdleAll
+	 */
+	OnIdle(conn IConn, kind int)
+}
+
+/**
+ * 主动心跳接口，每个Interval生成一次心跳包，以高优先级发送
+ */
+type HeartbeatProvider interface {
+	/**
+	 * @brief: 生成心跳包
+	 * @param1 conn: 当前连接
+	 * @return1: 心跳包数据，为nil时本次不发送
+	 */
+	Ping(conn IConn)[]byte
+}
+
+/**
+ * 心跳回复识别接口，HeartbeatProvider可选实现，用于计算往返时间
+ * 接收到的数据在交给DataHandler前先经过IsPong检查，识别为回复后仍会交给DataHandler
+ */
+type HeartbeatMatcher interface {
+	/**
+	 * @brief: 是否为心跳回复
+	 * @param1 data: 接收到的数据，tcp为当前接收缓冲区中的全部数据
+	 * @param2 conn: 当前连接
+	 */
+	IsPong(data []byte, conn IConn)bool
+}
+
+/**
+ * udp会话地址变化回调接口，ConnCallback可选实现
+ * 设置SessionKeyFunc后，已有会话从新地址收到数据时（例如NAT映射变化、终端漫游）更新会话地址并回调
+ */
+type AddressChangeHandler interface {
+	/**
+	 * @brief: 会话地址变化回调
+	 * @param1 conn: 连接，GetRemoteAddr已经是新地址
+	 * @param2 oldAddr: 原地址
+	 */
+	OnAddressChanged(conn IConn, oldAddr string)
+}
+
+/**
+ * ws升级回调接口，ConnCallback可选实现
+ * 在websocket握手之前调用，用于校验header、query或者cookie中的token，拒绝时回复HTTP状态码，不创建连接
+ */
+type UpgradeHandler interface {
+	/**
+	 * @brief: 升级回调
+	 * @param1 req: 升级请求，升级后仍可通过WsConn.GetHeader、GetCookie获取
+	 * @return1: 是否接受
+	 * @return2: 拒绝时回复的HTTP状态码，<=0时为403
+	 * @return3: 接受时预先设置到连接Tag的数据，OnConnected中即可获取
+	 */
+	OnUpgrade(req *http.Request)(accept bool, status int, tags map[string]interface{})
+}
+
+/**
+ * @brief: udp会话key计算函数，根据数据内容确定所属会话，例如SIP Call-ID、设备id、RTP SSRC
+ * @param1 data: 数据报，只在调用期间有效
+ * @param2 addr: 来源地址
+ * @return1: 会话key，返回空字符串时使用来源地址
+ */
+type SessionKeyFunc func(data []byte, addr net.Addr)string
+
+/**
+ * udp无会话数据报处理接口，用于大量来源地址、无需会话的场景
+ * 设置后不为来源地址创建连接，不做心跳、超时检测，也不触发ConnCallback
+ */
+type PacketHandler interface {
+	/**
+	 * @brief: 处理数据报，在接收协程中执行
+	 * @param1 data: 数据报，只在HandlePacket期间有效，需要保留时自行拷贝
+	 * @param2 from: 来源地址
+	 * @param3 reply: 向来源地址回复数据，HandlePacket返回后仍可调用
+	 */
+	HandlePacket(data []byte, from net.Addr, reply func([]byte) error)
+}
+
+/**
+ * 发送优先级，发送队列总是先发送高优先级数据
+ */
+const (
+	PriorityHigh   = 0 // 高优先级，心跳回复、BYE等控制消息
+	PriorityNormal = 1 // 普通优先级，Send默认使用
+	PriorityBulk   = 2 // 批量优先级，媒体等大量数据
+)
+
 /**
  * tcp 配置信息
  */
 type Config struct {
-	Ip            string            // ip
+	Ip            string            // ip，支持ipv6；unix、unixpacket、unixgram为socket文件路径
 	Port          int               // 端口
-	Network       string            // 默认tcp, 另外可以有tcp4, tcp6, "unix" or "unixpacket", udp, ws(websocket）
+	Network       string            // 默认tcp, 另外可以有tcp4, tcp6, "unix" or "unixpacket", udp, udp4, udp6, unixgram, rudp(可靠有序udp，仅支持xconn之间通信), ws(websocket）
 	Interval      time.Duration     // 心跳间隔
-	Timeout       time.Duration     // 超时时间
-	BufSize       int               // 接收缓冲区大小
-	SendChanSize  int               // 发送通道大小
-	RecvChanSize  int               // 接收通道大小
+	Timeout       time.Duration     // 超时时间，即读空闲时间，ReaderIdle为0时使用
+	ReaderIdle    time.Duration     // 读空闲时间，超过该时间未收到数据触发IdleReader
+	WriterIdle    time.Duration     // 写空闲时间，超过该时间未发送数据触发IdleWriter，0不检测
+	AllIdle       time.Duration     // 读写空闲时间，超过该时间既未收到也未发送数据触发IdleAll，0不检测
+	BufSize       int               // 接收缓冲区大小，tcp为接收ringBuf初始大小
+	MaxBufSize    int               // 接收缓冲区最大值，tcp数据包超过BufSize时ringBuf自动扩容至该值，默认1MB
+	LockFreeBuf   bool              // tcp接收ringBuf使用无锁SPSC实现，同样从BufSize扩容至MaxBufSize，容量向上取2的幂
+	EventLoop     bool              // tcp使用epoll事件循环模式（仅linux），连接不再占用收发协程，回调与DataHandler在事件循环协程中执行，不能阻塞
+	EventLoops    int               // 事件循环协程数，默认CPU核数
+	SendChanSize  int               // 发送通道大小，普通优先级
+	SendHighChanSize int            // 高优先级发送通道大小，默认同SendChanSize
+	SendBulkChanSize int            // 批量优先级发送通道大小，默认同SendChanSize
+	SendStarveLimit int             // 发送防饿死阈值，连续发送该数量的高优先级数据后至少发送一个低优先级数据，默认16
+	RecvChanSize  int               // 接收通道大小，WorkerCount>0时为每个连接接收队列的容量
+	WorkerCount   int               // DataHandler处理协程池大小，<=0时在各连接的接收协程中直接处理
+	RecvFullPolicy string           // 接收队列已满时的处理策略，RecvFullBlock(默认)、RecvFullDrop、RecvFullClose
+	UdpReaders    int               // udp接收并发数，默认1，见UdpReusePort
+	MulticastGroups []string        // udp加入的组播地址，例如239.255.255.250，不为空时监听通配地址的Port端口，DataHandler中可通过UdpConn.GetGroup获取目的组播地址
+	MulticastInterfaces []string    // 加入组播的网卡名，为空时使用系统默认网卡，第一个网卡同时作为组播发送网卡
+	MulticastTTL  int               // 组播发送TTL（ipv6为跳数限制），默认1
+	MulticastLoopback bool          // 组播发送是否回环到本机
+	RudpMtu       int               // rudp单个udp数据报最大长度，默认1400
+	RudpWindow    int               // rudp收发窗口，数据段数，默认128
+	UdpFragmentSize int             // udp分片长度（包含12字节分片头），>0时每个数据报都带分片头，超过该长度的数据拆分为多个分片，接收端重组后交给DataHandler，没有分片头的数据报丢弃；需要两端都是xconn，SessionKeyFunc收到的是带分片头的数据报；rudp无效
+	UdpReassemblyTimeout time.Duration // udp分片重组超时，默认5s
+	UdpReassemblyMaxBytes int       // 每个udp会话重组中的分片最大占用内存，默认4MB
+	UdpReassemblyTotalBytes int     // 所有udp会话重组中的分片共用的最大占用内存，默认64MB
+	UdpBatchSize  int               // udp单次系统调用收发的最大数据报数，>1时linux使用recvmmsg/sendmmsg，其他平台逐个收发，默认1
+	UdpReusePort  bool              // udp以SO_REUSEPORT打开UdpReaders个socket（仅linux），由内核按地址分发，设置了SessionKeyFunc时会话换地址后可能换socket，再按会话key分发给UdpReaders个处理协程；否则一个接收协程读取socket，按会话key哈希分发给UdpReaders个处理协程，同一会话按接收顺序处理；PacketHandler模式为UdpReaders个接收协程并发读取，不保证顺序
 	DataHandler DataHandler     // 包解析器
+	SessionKeyFunc SessionKeyFunc   // udp会话key计算函数，为nil时按来源地址区分会话
+	PacketHandler PacketHandler     // udp无会话模式，不为nil时数据报直接交给PacketHandler，不创建连接，DataHandler无效
 	ConnCallback  ConnCallback      // 连接回调接口
+	Heartbeat     HeartbeatProvider // 主动心跳，每个Interval发送一次，为nil时不发送；ws为nil时默认使用ping/pong控制帧
 	Label         string            // 标签
 	WsUrls        map[string]string // key: path, value: text(或者binary), 当Type为ws有效
-	WsGin         *gin.Engine       // websocket 对应的gin engine对象，当Type为ws有效
+	WsGin         *gin.Engine       // websocket 对应的gin engine对象，当Type为ws有效，由调用方运行
+	WsRoutes      []WsRoute         // websocket 路由，与WsUrls合并，同一路径以WsRoutes为准；运行中可通过Server.AddWsRoute、RemoveWsRoute增删
+	WsMux         *http.ServeMux    // websocket 注册到该ServeMux，当Type为ws且WsGin为nil时有效，由调用方运行；都为nil时在Ip:Port启动独立http服务
+	WsAllowedOrigins []string       // ws允许的Origin，例如https://example.com或example.com，"*"允许所有；为空时只允许与Host同源，没有Origin头的非浏览器客户端总是允许
+	WsSubprotocols []string         // ws服务端支持的子协议，按优先顺序与客户端协商，协商结果通过WsConn.Subprotocol获取
+	WsEnableCompression bool        // ws开启permessage-deflate压缩协商
+	WsCompressionLevel int          // ws压缩级别，-2~9（compress/flate），0使用默认级别1
+	WsReadBufferSize int            // ws读缓冲区大小，默认4096
+	WsWriteBufferSize int           // ws写缓冲区大小，默认4096
+	WsWriteBufferPool bool          // ws写缓冲区使用共享池，连接空闲时归还，适合大量空闲连接的场景
+	WsHandshakeTimeout time.Duration // ws握手超时，默认5s
+	WsReadLimit   int64             // ws单个消息最大长度，超过时以1009关闭连接，开启压缩时按解压后的长度计算，<=0不限制
+}
+
+/**
+ * websocket路由，每个路径单独的处理、回调和升级配置，零值字段使用Config中对应的配置
+ */
+type WsRoute struct {
+	Path          string            // 路径
+	MsgType       string            // text或者binary，Send使用的消息类型
+	DataHandler   DataHandler       // 包解析器
+	ConnCallback  ConnCallback      // 连接回调接口，可选接口（IdleHandler、UpgradeHandler）同样按路由生效
+	Label         string            // 标签
+	AllowedOrigins []string         // 同Config.WsAllowedOrigins
+	Subprotocols  []string          // 同Config.WsSubprotocols
+	EnableCompression bool          // 同Config.WsEnableCompression
+	CompressionLevel int            // 同Config.WsCompressionLevel
+	ReadBufferSize int              // 同Config.WsReadBufferSize
+	WriteBufferSize int             // 同Config.WsWriteBufferSize
+	WriteBufferPool bool            // 同Config.WsWriteBufferPool
+	HandshakeTimeout time.Duration  // 同Config.WsHandshakeTimeout
+	ReadLimit     int64             // 同Config.WsReadLimit
 }
 
 /**
@@ -81,6 +306,7 @@ type IConn interface {
 	Start()
 	Close()
 	Send([]byte)
+	SendPriority([]byte, int)
 	GetId()string
 	GetTag(string)interface{}
 	SetTag(string, interface{})
@@ -88,4 +314,5 @@ type IConn interface {
 	SetLabel(string)
 	GetRemoteAddr()string
 	GetLocalAddr()string
+	GetRTT()time.Duration
 }
@@ -62,6 +62,7 @@ type LenSplitter struct {
 
 /**
  * 拆分数据包
+ * 返回的数据包与剩余数据都是data的子切片，不做拷贝，有效期与data相同
  */
 func (ls *LenSplitter)Split(data []byte, con IConn)([][]byte, []byte, error){
 	if len(data) < int(ls.lenByteCount){
@@ -1,15 +1,18 @@
 package server
 
 import (
-	"github.com/gin-gonic/gin"
+	"context"
+	"errors"
 	"github.com/golang/glog"
-	"github.com/gorilla/websocket"
 	"net"
 	"net/http"
+	"os"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 	"xconn/common"
+	"xconn/tools"
 )
 
 /**
@@ -17,11 +20,25 @@ import (
  */
 type Server struct {
 	config       *common.Config      // 配置
-	connMap      sync.Map     // 连接列表,ip:port为key, conn为value
+	connMap      sync.Map     // 连接列表,ip:port为key（udp为会话key）, conn为value
 	connCallback common.ConnCallback // 回调函数
+	workers      *tools.WorkerPool   // DataHandler处理协程池，WorkerCount<=0时为nil
+	loops        []*eventLoop        // tcp事件循环，EventLoop为false时为nil
+	loopIndex    uint32              // 事件循环轮询分配计数
+	udpConns     []net.PacketConn    // udp、unixgram监听socket
+	unixgramPath string              // unixgram监听的socket文件，关闭socket时不会删除，Stop时删除
+	multicast    *udpMulticast       // udp组播，未配置MulticastGroups时为nil
+	dispatcher   *tools.DataTransport // udp多接收协程共用socket时的分发队列
+	listener     net.Listener        // tcp监听
+	httpServer   *http.Server        // ws独立http服务，使用WsGin、WsMux时为nil
+	udpMu        sync.Mutex          // udp会话创建锁
+	reassembly   *tools.ReassemblyBudget // 所有udp会话分片重组共用的内存上限，未开启分片时为nil
 
 	// websocket相关
-	upgrader websocket.Upgrader
+	wsRoutes     sync.Map            // ws路由表，path为key，*wsRoute为value
+	wsPaths      map[string]bool     // 已注册到路由器的路径
+	wsMux        *http.ServeMux      // ws注册的ServeMux，使用WsGin时为nil
+	wsMu         sync.Mutex          // ws路径注册锁
 }
 
 func NewServer(config *common.Config)*Server {
@@ -36,24 +53,48 @@ func NewServer(config *common.Config)*Server {
 	}
 	config.ConnCallback = s
 
+	// 默认值在这里统一设置，连接在多个协程中创建，不能再修改config
+	if config.BufSize <= 0{
+		config.BufSize = 1024
+	}
+	if config.MaxBufSize <= 0{
+		config.MaxBufSize = 1 << 20
+	}
+	if config.MaxBufSize < config.BufSize{
+		config.MaxBufSize = config.BufSize
+	}
+
+	if config.WorkerCount > 0 {
+		s.workers = tools.NewWorkerPool(config.WorkerCount)
+	}
+	if config.UdpFragmentSize > 0 && config.Network != "rudp" {
+		s.reassembly = tools.NewReassemblyBudget(config.UdpReassemblyTotalBytes)
+	}
+
 	if config.Network == "ws" {
 		// websocket额外设置
-		s.upgrader = websocket.Upgrader{
-			ReadBufferSize:   4096,
-			WriteBufferSize:  4096,
-			HandshakeTimeout: 5 * time.Second,
-			// 取消ws跨域校验
-			CheckOrigin: func(r *http.Request) bool {
-				return true
-			}}
+		s.wsPaths = make(map[string]bool)
+		if config.WsGin == nil {
+			s.wsMux = config.WsMux
+			if s.wsMux == nil {
+				s.wsMux = http.NewServeMux()
+			}
+		}
 	}
 	return s
 }
 
 func (ts *Server)Start() {
+	if ts.workers != nil {
+		ts.workers.Start()
+	}
+
 	if ts.config.Network == "tcp" || ts.config.Network == "tcp4" || ts.config.Network == "tcp6" || ts.config.Network == "unix" || ts.config.Network == "unixpacket" {
+		if ts.config.EventLoop {
+			ts.loops = startEventLoops(ts.config.EventLoops)
+		}
 		ts.startTcpServer()
-	} else if ts.config.Network == "udp" {
+	} else if ts.config.Network == "udp" || ts.config.Network == "udp4" || ts.config.Network == "udp6" || ts.config.Network == "rudp" || ts.config.Network == "unixgram" {
 		ts.startUdpServer()
 	} else if ts.config.Network == "ws" {
 		ts.startWsServer()
@@ -69,23 +110,34 @@ func (ts *Server)startTcpServer(){
 		network = "tcp"
 	}
 
-	listen, err := net.Listen(network, ts.config.Ip + ":" + strconv.Itoa(ts.config.Port))
+	listen, err := net.Listen(network, ts.listenAddress())
 	if err != nil {
 		glog.Errorln("监听端口失败：", err.Error())
 		return
 	}
+	ts.listener = listen
 
 	go func() {
 		for {
 			conn, err := listen.Accept()
 			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					// Stop
+					return
+				}
 				glog.Errorln("接受TCP连接异常:", err.Error())
 				continue
 			}
 			glog.Infoln("TCP连接来自:", conn.RemoteAddr().String())
 
+			if ts.loops != nil {
+				// 事件循环模式，不为连接启动协程
+				ts.startEpollConn(conn)
+				continue
+			}
+
 			go func(conn net.Conn, config *common.Config){
-				iconn := newTcpConn(conn, config)
+				iconn := newTcpConn(conn, config, ts.workers)
 				iconn.Start()
 			}(conn, ts.config)
 		}
@@ -95,66 +147,460 @@ func (ts *Server)startTcpServer(){
 }
 
 /**
- * @brief: 启动UDP服务端
+ * @brief: 按轮询分配事件循环并注册连接
+ */
+func (ts *Server)startEpollConn(conn net.Conn){
+	loop := ts.loops[atomic.AddUint32(&ts.loopIndex, 1) % uint32(len(ts.loops))]
+	iconn, err := newEpollConn(conn, ts.config, ts.workers, loop)
+	if err != nil {
+		glog.Errorln("创建事件循环连接失败:", err.Error())
+		conn.Close()
+		return
+	}
+	iconn.Start()
+}
+
+/**
+ * @brief: 启动UDP服务端，支持udp、udp4、udp6、rudp、unixgram
  */
 func (ts *Server)startUdpServer(){
-	addr, err := net.ResolveUDPAddr("udp", ts.config.Ip + ":" + strconv.Itoa(ts.config.Port))
-	if err != nil{
-		glog.Errorln(err.Error())
+	readers := ts.config.UdpReaders
+	if readers <= 0 {
+		readers = 1
+	}
+
+	network := ts.udpNetwork()
+	if network == "unixgram" {
+		path := ts.listenAddress()
+		removeStaleUnixgram(path)
+		conn, err := net.ListenUnixgram(network, &net.UnixAddr{Name: path, Net: network})
+		if err != nil {
+			glog.Errorln(err.Error())
+			return
+		}
+		ts.unixgramPath = path
+		ts.startUdpReaders(conn, readers)
 		return
 	}
 
-	conn, err := net.ListenUDP("udp", addr)
+	addr, err := net.ResolveUDPAddr(network, ts.listenAddress())
 	if err != nil{
 		glog.Errorln(err.Error())
 		return
 	}
 
+	if len(ts.config.MulticastGroups) > 0 {
+		ts.startUdpMulticast(readers)
+		return
+	}
 
-	go func() {
-		buf := make([]byte, 65535)
-		for {
-			n, radd, err := conn.ReadFromUDP(buf)
+	if readers > 1 && ts.config.UdpReusePort {
+		// 每个socket一个接收协程，内核保证同一地址总是分发到同一个socket
+		conns := make([]net.PacketConn, 0, readers)
+		for i := 0; i < readers; i++ {
+			conn, err := listenUdpReusePort(network, addr.String())
 			if err != nil {
-				glog.Errorln(err.Error())
-				continue
+				glog.Errorln("SO_REUSEPORT监听失败:", err.Error())
+				break
 			}
-			if n <= 0 {
-				continue
+			conns = append(conns, conn)
+		}
+		if len(conns) == readers {
+			ts.udpConns = conns
+			var dispatcher *tools.DataTransport
+			if ts.config.SessionKeyFunc != nil && ts.config.PacketHandler == nil {
+				// 会话换地址后内核可能分发到另一个socket，按会话key汇总分发，同一会话不会在两个接收协程中同时处理
+				dispatcher = ts.newUdpDispatcher(readers)
 			}
+			for _, conn := range conns {
+				go ts.readUdp(conn, dispatcher)
+			}
+			return
+		}
+		for _, conn := range conns {
+			conn.Close()
+		}
+		glog.Warningln("SO_REUSEPORT不可用，改为一个socket分发处理")
+	}
 
-			copyBuf := copyBytes(buf[:n])
-			if v, ok := ts.connMap.Load(radd.String()); ok {
-				if ccon, ok1 := v.(*UdpConn); ok1 {
-					ccon.recv(copyBuf)
-				}
-			} else {
-				ccon := newUdpConn(conn, radd, ts.config)
-				ccon.Start()
-				ccon.recv(copyBuf)
+	conn, err := net.ListenUDP(network, addr)
+	if err != nil{
+		glog.Errorln(err.Error())
+		return
+	}
+	ts.startUdpReaders(conn, readers)
+}
+
+/**
+ * @brief: 删除上次未正常退出留下的unixgram socket文件，否则无法再次监听；还有进程在监听或不是socket文件时不删除
+ */
+func removeStaleUnixgram(path string){
+	fi, err := os.Lstat(path)
+	if err != nil || fi.Mode() & os.ModeSocket == 0 {
+		return
+	}
+	if c, err := net.Dial("unixgram", path); err == nil {
+		// 仍在使用
+		c.Close()
+		return
+	}
+	if err := os.Remove(path); err != nil {
+		glog.Errorln("删除unixgram socket文件失败:", err.Error())
+	}
+}
+
+/**
+ * @brief: 数据报监听使用的network，rudp基于udp
+ */
+func (ts *Server)udpNetwork()string{
+	if ts.config.Network == "rudp" {
+		return "udp"
+	}
+	return ts.config.Network
+}
+
+/**
+ * @brief: 监听地址，unix系列为socket文件路径，其他为host:port
+ */
+func (ts *Server)listenAddress()string{
+	switch ts.config.Network {
+	case "unix", "unixpacket", "unixgram":
+		return ts.config.Ip
+	}
+	return net.JoinHostPort(ts.config.Ip, strconv.Itoa(ts.config.Port))
+}
+
+/**
+ * @brief: 解析对端地址
+ */
+func (ts *Server)resolvePeerAddr(addr string)(net.Addr, error){
+	network := ts.udpNetwork()
+	if network == "unixgram" {
+		return net.ResolveUnixAddr(network, addr)
+	}
+	return net.ResolveUDPAddr(network, addr)
+}
+
+/**
+ * @brief: 启动udp组播监听，组播不使用SO_REUSEPORT
+ */
+func (ts *Server)startUdpMulticast(readers int){
+	conn, mc, err := listenMulticast(ts.config)
+	if err != nil {
+		glog.Errorln("组播监听失败:", err.Error())
+		return
+	}
+	ts.multicast = mc
+	ts.startUdpReaders(conn, readers)
+}
+
+/**
+ * @brief: 在一个socket上启动接收协程
+ */
+func (ts *Server)startUdpReaders(conn net.PacketConn, readers int){
+	ts.udpConns = []net.PacketConn{conn}
+
+	if readers == 1 || ts.config.PacketHandler != nil {
+		// 无会话模式不需要保序，多个接收协程并发读取
+		for i := 0; i < readers; i++ {
+			go ts.readUdp(conn, nil)
+		}
+		return
+	}
+
+	// 多个协程并发读取同一socket无法保证同一会话的顺序，一个接收协程读取，按会话key哈希分发给处理协程
+	go ts.readUdp(conn, ts.newUdpDispatcher(readers))
+}
+
+/**
+ * @brief: 创建按会话key分发数据报的处理协程，同一会话的数据报按分发顺序在同一个处理协程中处理
+ * @param1 workers: 处理协程数
+ */
+func (ts *Server)newUdpDispatcher(workers int)*tools.DataTransport{
+	dispatcher := tools.NewDataTransport(workers, ts.config.RecvChanSize)
+	ts.dispatcher = dispatcher
+	dispatcher.Consume(func(data interface{}) bool {
+		p := data.(*udpPacket)
+		ts.dispatchUdp(p.conn, p.addr, p.dst, p.key, p.data)
+		tools.PutBytes(p.data)
+		return true
+	})
+	return dispatcher
+}
+
+/**
+ * @brief: 接收协程之间转交的数据报
+ */
+type udpPacket struct {
+	conn net.PacketConn // 接收的socket
+	addr net.Addr
+	dst  net.IP // 目的地址，组播socket有效
+	key  string // 会话key
+	data []byte // 池化缓冲区，处理完成后归还
+}
+
+/**
+ * @brief: udp接收协程
+ * @param1 conn: socket
+ * @param2 dispatcher: 不为nil时拷贝后按会话key分发给处理协程，否则直接处理
+ */
+func (ts *Server)readUdp(conn net.PacketConn, dispatcher *tools.DataTransport){
+	// 接收缓冲区复用，recv返回后即可覆盖，需要排队处理时由UdpConn拷贝
+	batch := newUdpBatch(conn, ts.config.UdpBatchSize, true)
+	batch.mc = ts.multicast
+	defer batch.release()
+	handle := func(data []byte, radd net.Addr, dst net.IP) {
+		if radd == nil {
+			// 未绑定地址的unixgram对端无法回复，也无法区分会话
+			glog.Warningln("数据报没有来源地址，丢弃", len(data))
+			return
+		}
+		if ts.config.PacketHandler != nil {
+			// 无会话模式，不需要按地址保序，直接在接收协程中处理
+			ts.handlePacket(conn, radd, data)
+			return
+		}
+		key := ts.udpSessionKey(data, radd)
+		if dispatcher == nil {
+			ts.dispatchUdp(conn, radd, dst, key, data)
+			return
+		}
+		buf := tools.GetBytes(len(data))
+		copy(buf, data)
+		// 按会话key分发，地址变化后同一会话仍在同一个处理协程中
+		dispatcher.ProduceKey(key, &udpPacket{conn: conn, addr: radd, dst: dst, key: key, data: buf})
+	}
+	for {
+		if err := batch.read(handle); err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				// Stop
+				return
 			}
+			glog.Errorln(err.Error())
+		}
+	}
+}
+
+/**
+ * @brief: 无会话模式处理数据报
+ */
+func (ts *Server)handlePacket(conn net.PacketConn, radd net.Addr, data []byte){
+	defer func() {
+		if x := recover(); x != nil {
+			glog.Errorln("HandlePacket recover:", x)
 		}
 	}()
+
+	ts.config.PacketHandler.HandlePacket(data, radd, func(b []byte) error {
+		_, err := conn.WriteTo(b, radd)
+		return err
+	})
+}
+
+/**
+ * @brief: 计算数据报所属的会话key
+ */
+func (ts *Server)udpSessionKey(data []byte, radd net.Addr)string{
+	if ts.config.SessionKeyFunc != nil {
+		if key := ts.config.SessionKeyFunc(data, radd); key != "" {
+			return key
+		}
+	}
+	return radd.String()
+}
+
+/**
+ * @brief: 按会话key查找会话并处理数据报，不存在时创建，已有会话来自新地址时更新地址
+ * @param1 conn: 收到数据报的socket，新会话使用该socket发送
+ */
+func (ts *Server)dispatchUdp(conn net.PacketConn, radd net.Addr, dst net.IP, key string, data []byte){
+	var ccon *UdpConn
+	if v, ok := ts.connMap.Load(key); ok {
+		ccon, _ = v.(*UdpConn)
+		if ccon == nil {
+			return
+		}
+		if ts.config.SessionKeyFunc != nil {
+			ccon.updateAddr(radd)
+		}
+	} else {
+		ccon = ts.udpSession(conn, radd, key)
+	}
+
+	if ts.multicast != nil {
+		ccon.setGroup(dst)
+	}
+	ccon.recv(data)
+}
+
+/**
+ * @brief: 从组播socket发送数据到组播组，开启分片时按UdpFragmentSize拆分
+ * @param1 group: 组播地址，ip:port
+ * @param2 data: 数据
+ */
+func (ts *Server)SendMulticast(group string, data []byte)error{
+	if ts.multicast == nil || len(ts.udpConns) == 0 {
+		return errors.New("udp multicast is not started")
+	}
+
+	gaddr, err := net.ResolveUDPAddr("udp", group)
+	if err != nil {
+		return err
+	}
+	if !gaddr.IP.IsMulticast() {
+		return errors.New("not a multicast address: " + group)
+	}
+
+	datas := [][]byte{data}
+	if mc := ts.multicast; mc.fragmenter != nil {
+		mc.fragMu.Lock()
+		datas = mc.fragmenter.Split(data)
+		mc.fragMu.Unlock()
+		if datas == nil {
+			return errors.New("data too large to fragment")
+		}
+	}
+	for _, d := range datas {
+		if _, err = ts.udpConns[0].WriteTo(d, gaddr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/**
+ * @brief: 获取或创建udp会话
+ * @param1 conn: 新会话使用的socket
+ */
+func (ts *Server)udpSession(conn net.PacketConn, radd net.Addr, key string)*UdpConn{
+	ts.udpMu.Lock()
+	defer ts.udpMu.Unlock()
+
+	if v, ok := ts.connMap.Load(key); ok {
+		if ccon, ok1 := v.(*UdpConn); ok1 {
+			return ccon
+		}
+	}
+	ccon := newUdpConn(conn, radd, key, ts.config, ts.workers, ts.reassembly)
+	// 先登记，OnConnected在会话协程中执行，期间到达的数据报不能再创建会话
+	ts.connMap.Store(key, ccon)
+	ccon.Start()
+	return ccon
+}
+
+/**
+ * @brief: 服务端主动创建udp会话，用于对端还没有发送过数据时先发送，例如向设备发送INVITE
+ * 会话使用监听socket发送，对端的回复交给同一个会话，已存在会话时直接返回
+ * @param1 addr: 对端地址，host:port，unixgram为socket文件路径
+ */
+func (ts *Server)OpenUDPSession(addr string)(common.IConn, error){
+	return ts.OpenUDPSessionKey(addr, "")
+}
+
+/**
+ * @brief: 服务端主动创建指定会话key的udp会话，设置SessionKeyFunc时使用，使对端回复的数据归入该会话
+ * @param1 addr: 对端地址，host:port，unixgram为socket文件路径
+ * @param2 key: 会话key，为空时使用对端地址
+ */
+func (ts *Server)OpenUDPSessionKey(addr, key string)(common.IConn, error){
+	if ts.config.PacketHandler != nil {
+		return nil, errors.New("udp packet mode has no session")
+	}
+	if len(ts.udpConns) == 0 {
+		return nil, errors.New("udp server is not started")
+	}
+
+	radd, err := ts.resolvePeerAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	if key == "" {
+		key = radd.String()
+	}
+	return ts.udpSession(ts.udpConns[0], radd, key), nil
 }
 
 /**
  * @brief: 启动ws服务端
+ * 指定了WsGin或WsMux时注册到对应的路由，由调用方负责运行http服务；否则在Ip:Port启动独立的http服务
  */
 func (ts *Server)startWsServer(){
 	for path, wsMsgType := range ts.config.WsUrls{
-		go func(p, mt string){
-			ts.config.WsGin.GET(p, func(ctx *gin.Context) {
-				conn, err := ts.upgrader.Upgrade(ctx.Writer, ctx.Request, nil)
-				if err != nil {
-					glog.Error(err)
-					ctx.JSON(500, gin.H{"code": 500, "msg": err.Error(), "data": nil})
-					return
-				}
+		if _, ok := ts.wsRoutes.Load(path); ok {
+			continue
+		}
+		ts.AddWsRoute(common.WsRoute{Path: path, MsgType: wsMsgType})
+	}
+	for _, route := range ts.config.WsRoutes{
+		if err := ts.AddWsRoute(route); err != nil {
+			glog.Errorln("ws路由无效:", err.Error())
+		}
+	}
+	if ts.config.WsGin != nil || ts.config.WsMux != nil {
+		return
+	}
+
+	listen, err := net.Listen("tcp", ts.listenAddress())
+	if err != nil {
+		glog.Errorln("监听端口失败：", err.Error())
+		return
+	}
+	ts.httpServer = &http.Server{Handler: ts.wsMux}
+	go func() {
+		if err := ts.httpServer.Serve(listen); err != nil && err != http.ErrServerClosed {
+			glog.Errorln("ws服务异常:", err.Error())
+		}
+	}()
+}
+
+/**
+ * @brief: 停止服务，关闭监听和所有连接
+ */
+func (ts *Server)Stop(){
+	if ts.httpServer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+		if err := ts.httpServer.Shutdown(ctx); err != nil {
+			glog.Errorln("ws服务关闭异常:", err.Error())
+		}
+		cancel()
+	}
+	if ts.listener != nil {
+		ts.listener.Close()
+	}
+	for _, conn := range ts.udpConns {
+		conn.Close()
+	}
+	if ts.unixgramPath != "" {
+		// 与unix监听不同，unixgram关闭时不删除socket文件
+		os.Remove(ts.unixgramPath)
+	}
+
+	// 被升级、接管的连接不受http服务关闭影响，需要逐个关闭
+	for _, conn := range ts.GetAllConn() {
+		conn.Close()
+	}
+
+	// 事件循环先执行完上面提交的关闭任务，再关闭剩余连接并退出
+	dones := make([]<-chan struct{}, 0, len(ts.loops))
+	for _, l := range ts.loops {
+		dones = append(dones, l.stop())
+	}
+	timeout := time.After(5 * time.Second)
+wait:
+	for _, done := range dones {
+		select {
+		case <-done:
+		case <-timeout:
+			glog.Errorln("事件循环退出超时")
+			break wait
+		}
+	}
 
-				wsconn := newWsConn(conn, ctx, ts.config, p, mt)
-				wsconn.Start()
-			})
-		}(path, wsMsgType)
+	if ts.dispatcher != nil {
+		ts.dispatcher.Cancel()
+	}
+	if ts.workers != nil {
+		ts.workers.Stop()
 	}
 }
 
@@ -182,10 +628,10 @@ func (ts *Server)OnConnected(conn common.IConn){
 		return
 	}
 
-	ts.connMap.Store(conn.GetRemoteAddr(), conn)
+	ts.connMap.Store(connKey(conn), conn)
 
-	if ts.connCallback != nil{
-		ts.connCallback.OnConnected(conn)
+	if cb := ts.callback(conn); cb != nil{
+		cb.OnConnected(conn)
 	}
 }
 
@@ -199,27 +645,59 @@ func (ts *Server)OnDisconnected(conn common.IConn){
 		return
 	}
 
-	ts.connMap.Delete(conn.GetRemoteAddr())
+	ts.connMap.Delete(connKey(conn))
 
-	if ts.connCallback != nil{
-		ts.connCallback.OnDisconnected(conn)
+	if cb := ts.callback(conn); cb != nil{
+		cb.OnDisconnected(conn)
 	}
 }
 
 /**
- * @brief: 错误回调
+ * @brief: 空闲回调，在时间轮协程中调用；应用实现了IdleHandler时在新协程中交给应用处理，否则读空闲关闭连接
  * @param1 conn: 连接
- * @param2 err: 错误信息
+ * @param2 kind: 空闲类型
  */
-func (ts *Server)OnError(conn common.IConn, err error){
-	if ts.connCallback != nil{
-		ts.connCallback.OnError(conn, err)
+func (ts *Server)OnIdle(conn common.IConn, kind int){
+	if h, ok := ts.callback(conn).(common.IdleHandler); ok{
+		// 应用回调可能阻塞，不占用时间轮协程
+		go h.OnIdle(conn, kind)
+		return
+	}
+
+	if kind == common.IdleReader{
+		glog.Infoln("读空闲，关闭连接", conn.GetLabel(), conn.GetRemoteAddr())
+		conn.Close()
 	}
 }
 
-func copyBytes(buf []byte)[]byte{
-	copyBuf := make([]byte, len(buf))
-	copy(copyBuf, buf)
+/**
+ * @brief: udp会话地址变化回调
+ * @param1 conn: 连接
+ * @param2 oldAddr: 原地址
+ */
+func (ts *Server)OnAddressChanged(conn common.IConn, oldAddr string){
+	if h, ok := ts.connCallback.(common.AddressChangeHandler); ok{
+		h.OnAddressChanged(conn, oldAddr)
+	}
+}
 
-	return copyBuf
+/**
+ * @brief: 连接在connMap中的key，udp会话为会话key，其他为对端地址
+ */
+func connKey(conn common.IConn)string{
+	if uc, ok := conn.(*UdpConn); ok {
+		return uc.sessionKey
+	}
+	return conn.GetRemoteAddr()
+}
+
+/**
+ * @brief: 错误回调
+ * @param1 conn: 连接
+ * @param2 err: 错误信息
+ */
+func (ts *Server)OnError(conn common.IConn, err error){
+	if cb := ts.callback(conn); cb != nil{
+		cb.OnError(conn, err)
+	}
 }
@@ -15,25 +15,44 @@ import (
 type TcpConn struct {
 	common.BaseConn
 	Conn         net.Conn             // 连接
+	pending      tools.IRingBuffer    // 使用接收队列或事件循环时未处理完的数据，只在处理协程中访问
 }
 
-func newTcpConn(conn net.Conn, config *common.Config)*TcpConn {
+func newTcpConn(conn net.Conn, config *common.Config, workers *tools.WorkerPool)*TcpConn {
 	ci := &TcpConn{
 		Conn:  conn,
 	}
 	ci.Id = uuid.New().String()
 	ci.RemoteAddress = conn.RemoteAddr().String()
 	ci.LocalAddr = conn.LocalAddr().String()
-	ci.Sender = tools.NewDataTransport(1, config.SendChanSize)
+	ci.Sender = common.NewSender(config)
 	ci.Done = make(chan bool, 1)
-	ci.TimeoutCheck = tools.NewTimeoutCheck(config.Interval, config.Timeout)
+	ci.TimeoutCheck = common.NewTimeoutCheck(config)
 	if config.BufSize <= 0{
 		config.BufSize = 1024
 	}
 	ci.RecvBufSize = config.BufSize
+	if config.MaxBufSize <= 0{
+		config.MaxBufSize = 1 << 20
+	}
+	if config.MaxBufSize < config.BufSize{
+		config.MaxBufSize = config.BufSize
+	}
+	ci.RecvBufMaxSize = config.MaxBufSize
+	ci.RecvBufLockFree = config.LockFreeBuf
 	ci.ConnCallback = config.ConnCallback
 	ci.DataHandler = config.DataHandler
 	ci.Label = config.Label
+	ci.Heartbeat = config.Heartbeat
+	ci.HeartbeatInterval = config.Interval
+	if workers != nil {
+		ci.Receiver = workers.NewTaskQueue(config.RecvChanSize, ci.handleChunk, releaseBytes)
+		ci.RecvFullPolicy = config.RecvFullPolicy
+		if ci.RecvFullPolicy == common.RecvFullDrop {
+			// 流数据不能丢弃
+			ci.RecvFullPolicy = common.RecvFullClose
+		}
+	}
 	ci.IConn = ci
 
 	return ci
@@ -53,6 +72,8 @@ func (cl *TcpConn)Start(){
 			// 新连接回调
 			cl.ConnCallback.OnConnected(cl)
 		}
+		cl.StartHeartbeatProcess()
+		cl.StartTimeoutCheckProcess()
 
 		<-cl.Done
 
@@ -64,7 +85,7 @@ func (cl *TcpConn)Start(){
 }
 
 func (cl *TcpConn)Close(){
-	cl.Close()
+	cl.BaseConn.Close()
 
 	if cl.Conn != nil{
 		cl.Conn.Close()
@@ -81,9 +102,10 @@ func (cl *TcpConn)startSendProcess() {
 				cl.Conn.SetWriteDeadline(time.Now().Add(time.Second * 5))
 				if _, err := cl.Conn.Write(bytess); err != nil {
 					glog.Errorln("conn.Write", err.Error())
-					cl.Done <- true
+					cl.Finish()
 					return false
 				}
+				cl.TimeoutCheck.TickWrite()
 			}
 		}
 		return true
@@ -97,13 +119,23 @@ func (cl *TcpConn)startSendProcess() {
 func (cl *TcpConn)startRecvProcess(){
 	go func() {
 		defer func() {
-			cl.Done <- true
+			cl.Finish()
 		}()
 
-		recvBuffer := make([]byte, cl.RecvBufSize)
-		ringBuf := tools.NewRingBuffer(65535)
+		if cl.Receiver != nil {
+			cl.recvToQueue()
+			return
+		}
+
+		// 直接读入ringBuf空闲区，Handle使用ringBuf内的切片，不做拷贝
+		ringBuf := tools.NewIRingBuffer(cl.RecvBufSize, cl.RecvBufMaxSize, cl.RecvBufLockFree)
+		defer ringBuf.Release()
 		for {
-			i, err := cl.Conn.Read(recvBuffer) // 读取数据
+			_, err := ringBuf.Fill(cl.Conn) // 读取数据
+			if err == tools.ErrIsFull {
+				glog.Errorln(cl.Label, "数据包超过本地缓存buf最大值:", ringBuf.MaxCapacity())
+				break
+			}
 			if err != nil {
 				glog.Errorln(cl.Label, "读取客户端数据错误:", err.Error())
 				if cl.ConnCallback != nil{
@@ -112,32 +144,135 @@ func (cl *TcpConn)startRecvProcess(){
 				}
 				break
 			}
-			i, err = ringBuf.Write(recvBuffer[0:i])
-			if err != nil {
-				glog.Errorln(cl.Label, "写入数据到本地换成buf错误:", err.Error())
-				break
-			}
 
 			// 处理数据
 			cl.TimeoutCheck.Tick()
 
 			// handle data
 			if cl.DataHandler != nil {
-				left, err := cl.DataHandler.Handle(ringBuf.Bytes(), cl)
-				if err != nil {
-					glog.Errorln("getter get err", err.Error())
-					ringBuf.Reset()
-					continue
-				}
-
-				// 未处理完的重新写入
-				ringBuf.Reset()
-				if left != nil {
-					ringBuf.Write(left)
-				}
+				cl.handle(ringBuf, true)
 			}else{
+				ringBuf.Discard(ringBuf.Length())
 				glog.Errorln("data handler is nil")
 			}
 		}
 	}()
 }
+
+/**
+ * @brief: 处理ringBuf中的数据，处理完成的部分直接丢弃
+ * @param1 ringBuf: 接收缓存
+ * @param2 matchPong: 是否检查心跳回复，读取时已检查过的传false
+ */
+func (cl *TcpConn)handle(ringBuf tools.IRingBuffer, matchPong bool){
+	head, tail := ringBuf.Peek(ringBuf.Length())
+	data := head
+	if len(tail) > 0 {
+		// 数据跨越缓存尾部，拼接到临时缓冲区
+		data = tools.GetBytes(len(head) + len(tail))
+		copy(data, head)
+		copy(data[len(head):], tail)
+		defer tools.PutBytes(data)
+	}
+
+	if matchPong {
+		cl.MatchPong(data)
+	}
+	left, err := cl.DataHandler.Handle(data, cl.IConn)
+	if err != nil {
+		glog.Errorln("getter get err", err.Error())
+		ringBuf.Discard(len(data))
+		return
+	}
+
+	// left为未处理完的数据，保留在ringBuf中
+	ringBuf.Discard(len(data) - len(left))
+}
+
+/**
+ * @brief: 接收数据放入接收队列，由工作协程池调用handleChunk处理
+ */
+func (cl *TcpConn)recvToQueue(){
+	for {
+		chunk := tools.GetBytes(cl.RecvBufSize)
+		n, err := cl.Conn.Read(chunk) // 读取数据
+		if err != nil {
+			tools.PutBytes(chunk)
+			glog.Errorln(cl.Label, "读取客户端数据错误:", err.Error())
+			if cl.ConnCallback != nil{
+				cl.ConnCallback.OnError(cl, err)
+			}
+			return
+		}
+
+		cl.TimeoutCheck.Tick()
+		cl.MatchPong(chunk[:n])
+
+		if cl.DataHandler == nil || n <= 0 {
+			tools.PutBytes(chunk)
+			if cl.DataHandler == nil {
+				glog.Errorln("data handler is nil")
+			}
+			continue
+		}
+		if !cl.PushRecv(chunk[:n]) {
+			return
+		}
+	}
+}
+
+/**
+ * @brief: 工作协程中处理一次读取的数据，同一连接串行调用
+ * @param1 item: 池化的数据块，处理完成后归还
+ */
+func (cl *TcpConn)handleChunk(item interface{}){
+	chunk := item.([]byte)
+	defer tools.PutBytes(chunk)
+
+	cl.handleData(chunk)
+}
+
+/**
+ * @brief: 处理一次读取的数据，存在遗留数据时先拼接
+ * @param1 data: 读取的数据，仅在本次调用期间有效，剩余部分拷贝到pending
+ */
+func (cl *TcpConn)handleData(data []byte){
+	if cl.pending == nil {
+		// 没有遗留数据，直接处理数据块，只缓存剩余部分
+		left, err := cl.DataHandler.Handle(data, cl.IConn)
+		if err != nil {
+			glog.Errorln("getter get err", err.Error())
+			return
+		}
+		if len(left) == 0 {
+			return
+		}
+		cl.pending = tools.NewIRingBuffer(cl.RecvBufSize, cl.RecvBufMaxSize, cl.RecvBufLockFree)
+		if _, err := cl.pending.Write(left); err != nil {
+			glog.Errorln(cl.Label, "数据包超过本地缓存buf最大值:", cl.pending.MaxCapacity())
+			cl.Finish()
+		}
+		return
+	}
+
+	if _, err := cl.pending.Write(data); err != nil {
+		glog.Errorln(cl.Label, "数据包超过本地缓存buf最大值:", cl.pending.MaxCapacity())
+		cl.Finish()
+		return
+	}
+	cl.handle(cl.pending, false)
+
+	if cl.pending.IsEmpty() {
+		cl.pending.Release()
+		cl.pending = nil
+	}
+}
+
+/**
+ * @brief: 释放队列中被丢弃的池化数据
+ */
+func releaseBytes(item interface{}){
+	if data, ok := item.([]byte); ok {
+		tools.PutBytes(data)
+	}
+}
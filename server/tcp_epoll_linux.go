@@ -0,0 +1,444 @@
+package server
+
+import (
+	"errors"
+	"github.com/golang/glog"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"xconn/common"
+	"xconn/tools"
+)
+
+const (
+	epollRead  = syscall.EPOLLIN | syscall.EPOLLRDHUP
+	epollWrite = syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLOUT
+	epollEvents = 128   // 单次epoll_wait最大事件数
+	loopBufSize = 65536 // 事件循环共享读缓冲区大小
+)
+
+var errSendQueueFull = errors.New("send queue is full")
+
+/**
+ * @brief: epoll事件循环，负责一组连接的读写
+ */
+type eventLoop struct {
+	epfd    int                 // epoll fd
+	wakeR   int                 // 唤醒管道读端
+	wakeW   int                 // 唤醒管道写端
+	conns   map[int]*EpollConn  // fd对应的连接，只在事件循环协程中访问
+	buf     []byte              // 共享读缓冲区，数据只在Handle期间有效
+	tasks   []func()            // 需要在事件循环协程中执行的任务
+	tasksMu sync.Mutex
+	waking  int32               // 是否已写入唤醒管道
+	quit    bool                // 是否退出，只在事件循环协程中访问
+	stopped bool                // 是否已退出，之后提交的任务丢弃，由tasksMu保护
+	done    chan struct{}       // 退出并释放fd后关闭
+}
+
+/**
+ * @brief: 创建并启动事件循环
+ * @param1 n: 事件循环数量，<=0时为CPU核数
+ */
+func startEventLoops(n int)[]*eventLoop{
+	if n <= 0 {
+		n = runtime.NumCPU()
+	}
+
+	loops := make([]*eventLoop, 0, n)
+	for i := 0; i < n; i++ {
+		l, err := newEventLoop()
+		if err != nil {
+			glog.Errorln("创建事件循环失败:", err.Error())
+			break
+		}
+		go l.run()
+		loops = append(loops, l)
+	}
+	if len(loops) == 0 {
+		return nil
+	}
+	return loops
+}
+
+func newEventLoop()(*eventLoop, error){
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+
+	var p [2]int
+	if err := syscall.Pipe2(p[:], syscall.O_NONBLOCK | syscall.O_CLOEXEC); err != nil {
+		syscall.Close(epfd)
+		return nil, err
+	}
+	ev := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(p[0])}
+	if err := syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, p[0], &ev); err != nil {
+		syscall.Close(epfd)
+		syscall.Close(p[0])
+		syscall.Close(p[1])
+		return nil, err
+	}
+
+	return &eventLoop{
+		epfd:  epfd,
+		wakeR: p[0],
+		wakeW: p[1],
+		conns: make(map[int]*EpollConn),
+		buf:   make([]byte, loopBufSize),
+		done:  make(chan struct{}),
+	}, nil
+}
+
+/**
+ * @brief: 提交任务到事件循环协程执行
+ */
+func (l *eventLoop)trigger(f func()){
+	l.tasksMu.Lock()
+	defer l.tasksMu.Unlock()
+	if l.stopped {
+		// 管道已关闭，fd可能已被复用
+		return
+	}
+	l.tasks = append(l.tasks, f)
+
+	if atomic.CompareAndSwapInt32(&l.waking, 0, 1) {
+		syscall.Write(l.wakeW, []byte{1})
+	}
+}
+
+/**
+ * @brief: 停止事件循环，关闭其中的连接和epoll、唤醒管道
+ * @return1: 退出完成后关闭的通道，不能在事件循环协程中等待
+ */
+func (l *eventLoop)stop()<-chan struct{}{
+	l.trigger(func() {
+		l.quit = true
+	})
+	return l.done
+}
+
+/**
+ * @brief: 执行已提交的任务
+ */
+func (l *eventLoop)runTasks(){
+	var b [64]byte
+	for {
+		if n, _ := syscall.Read(l.wakeR, b[:]); n < len(b) {
+			break
+		}
+	}
+	atomic.StoreInt32(&l.waking, 0)
+
+	l.tasksMu.Lock()
+	tasks := l.tasks
+	l.tasks = nil
+	l.tasksMu.Unlock()
+
+	for _, f := range tasks {
+		f()
+	}
+}
+
+/**
+ * @brief: 事件循环
+ */
+func (l *eventLoop)run(){
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	defer l.exit()
+
+	events := make([]syscall.EpollEvent, epollEvents)
+	for !l.quit {
+		n, err := syscall.EpollWait(l.epfd, events, -1)
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			glog.Errorln("epoll_wait错误:", err.Error())
+			return
+		}
+
+		for i := 0; i < n; i++ {
+			fd := int(events[i].Fd)
+			if fd == l.wakeR {
+				l.runTasks()
+				continue
+			}
+			c, ok := l.conns[fd]
+			if !ok {
+				continue
+			}
+			ev := events[i].Events
+			if ev & syscall.EPOLLOUT != 0 {
+				c.flush()
+			}
+			if ev & (syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLHUP | syscall.EPOLLERR) != 0 {
+				c.read()
+			}
+		}
+	}
+}
+
+/**
+ * @brief: 退出事件循环，执行剩余任务、关闭所有连接后释放fd
+ */
+func (l *eventLoop)exit(){
+	l.tasksMu.Lock()
+	l.stopped = true
+	tasks := l.tasks
+	l.tasks = nil
+	l.tasksMu.Unlock()
+
+	// 剩余任务中可能有新连接的注册，执行后随其他连接一起关闭
+	for _, f := range tasks {
+		f()
+	}
+	for _, c := range l.conns {
+		c.close()
+	}
+
+	syscall.Close(l.epfd)
+	syscall.Close(l.wakeR)
+	syscall.Close(l.wakeW)
+	close(l.done)
+}
+
+/**
+ * @brief: 事件循环模式的tcp连接，不占用收发协程
+ * 读写都在所属事件循环协程中进行，发送数据先放入优先级队列，再由事件循环写出
+ */
+type EpollConn struct {
+	*TcpConn
+	loop     *eventLoop // 所属事件循环
+	fd       int        // socket fd
+	out      []byte     // 正在发送的数据剩余部分
+	writing  bool       // 是否已监听可写事件
+	flushing int32      // 是否已提交发送任务
+	closed   bool       // 是否已关闭，只在事件循环协程中访问
+}
+
+/**
+ * @brief: 创建事件循环模式的tcp连接
+ */
+func newEpollConn(conn net.Conn, config *common.Config, workers *tools.WorkerPool, loop *eventLoop)(*EpollConn, error){
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil, errors.New("conn does not support SyscallConn")
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	fd := -1
+	if err := raw.Control(func(f uintptr) { fd = int(f) }); err != nil {
+		return nil, err
+	}
+
+	ci := &EpollConn{
+		TcpConn: newTcpConn(conn, config, workers),
+		loop:    loop,
+		fd:      fd,
+	}
+	if ci.Receiver != nil {
+		// 事件循环不能阻塞
+		ci.RecvFullPolicy = common.RecvFullClose
+	}
+	// TcpConn中的处理流程通过IConn、Finish回到外层连接
+	ci.FinishHook = ci.Close
+	ci.IConn = ci
+
+	return ci, nil
+}
+
+/**
+ * @brief: 注册到事件循环
+ */
+func (cl *EpollConn)Start(){
+	cl.loop.trigger(func() {
+		ev := syscall.EpollEvent{Events: epollRead, Fd: int32(cl.fd)}
+		if err := syscall.EpollCtl(cl.loop.epfd, syscall.EPOLL_CTL_ADD, cl.fd, &ev); err != nil {
+			glog.Errorln(cl.Label, "注册epoll失败:", err.Error())
+			cl.TcpConn.Close()
+			return
+		}
+		cl.loop.conns[cl.fd] = cl
+
+		if cl.ConnCallback != nil {
+			// 新连接回调
+			cl.ConnCallback.OnConnected(cl)
+		}
+		cl.StartHeartbeatProcess()
+		cl.StartTimeoutCheckProcess()
+
+		// 注册前可能已有数据
+		cl.read()
+	})
+}
+
+/**
+ * @brief: 关闭，可以在任意协程调用
+ */
+func (cl *EpollConn)Close(){
+	cl.loop.trigger(cl.close)
+}
+
+/**
+ * @brief: 按优先级发送，可以在任意协程调用，发送队列已满时丢弃
+ */
+func (cl *EpollConn)SendPriority(data []byte, level int){
+	if data == nil{
+		glog.Errorln("发送数据位nil")
+		return
+	}
+
+	if !cl.Sender.TryProduce(data, level) {
+		glog.Errorln(cl.Label, cl.RemoteAddress, "发送队列已满，丢弃数据", len(data))
+		if cl.ConnCallback != nil {
+			cl.ConnCallback.OnError(cl, errSendQueueFull)
+		}
+		return
+	}
+	if atomic.CompareAndSwapInt32(&cl.flushing, 0, 1) {
+		cl.loop.trigger(func() {
+			atomic.StoreInt32(&cl.flushing, 0)
+			cl.flush()
+		})
+	}
+}
+
+func (cl *EpollConn)Send(data []byte){
+	cl.SendPriority(data, common.PriorityNormal)
+}
+
+/**
+ * @brief: 可读，读取到事件循环共享缓冲区后处理
+ */
+func (cl *EpollConn)read(){
+	for !cl.closed {
+		n, err := syscall.Read(cl.fd, cl.loop.buf)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err == syscall.EAGAIN {
+			return
+		}
+		if n == 0 && err == nil {
+			cl.close()
+			return
+		}
+		if err != nil {
+			glog.Errorln(cl.Label, "读取客户端数据错误:", err.Error())
+			if cl.ConnCallback != nil{
+				cl.ConnCallback.OnError(cl, err)
+			}
+			cl.close()
+			return
+		}
+
+		cl.TimeoutCheck.Tick()
+		data := cl.loop.buf[:n]
+		cl.MatchPong(data)
+
+		if cl.DataHandler == nil {
+			glog.Errorln("data handler is nil")
+		} else if cl.Receiver == nil {
+			cl.handleData(data)
+		} else {
+			// 共享缓冲区不能放入队列
+			chunk := tools.GetBytes(n)
+			copy(chunk, data)
+			if !cl.PushRecv(chunk) {
+				cl.close()
+				return
+			}
+		}
+
+		if n < len(cl.loop.buf) {
+			// 已读完，等待下一次可读事件
+			return
+		}
+	}
+}
+
+/**
+ * @brief: 按优先级写出发送队列中的数据，写满时监听可写事件
+ */
+func (cl *EpollConn)flush(){
+	for !cl.closed {
+		if len(cl.out) == 0 {
+			data, ok := cl.Sender.Next()
+			if !ok {
+				break
+			}
+			bytess, _ := data.([]byte)
+			cl.out = bytess
+			continue
+		}
+
+		n, err := syscall.Write(cl.fd, cl.out)
+		if n > 0 {
+			cl.out = cl.out[n:]
+			cl.TimeoutCheck.TickWrite()
+		}
+		if err == syscall.EINTR {
+			continue
+		}
+		if err == syscall.EAGAIN {
+			cl.watchWrite(true)
+			return
+		}
+		if err != nil {
+			glog.Errorln("conn.Write", err.Error())
+			cl.close()
+			return
+		}
+	}
+	cl.watchWrite(false)
+}
+
+/**
+ * @brief: 设置是否监听可写事件
+ */
+func (cl *EpollConn)watchWrite(on bool){
+	if cl.closed || cl.writing == on {
+		return
+	}
+
+	events := uint32(epollRead)
+	if on {
+		events = epollWrite
+	}
+	ev := syscall.EpollEvent{Events: events, Fd: int32(cl.fd)}
+	if err := syscall.EpollCtl(cl.loop.epfd, syscall.EPOLL_CTL_MOD, cl.fd, &ev); err != nil {
+		glog.Errorln(cl.Label, "修改epoll事件失败:", err.Error())
+		return
+	}
+	cl.writing = on
+}
+
+/**
+ * @brief: 在事件循环协程中关闭
+ */
+func (cl *EpollConn)close(){
+	if cl.closed {
+		return
+	}
+	cl.closed = true
+
+	registered := cl.loop.conns[cl.fd] == cl
+	if registered {
+		syscall.EpollCtl(cl.loop.epfd, syscall.EPOLL_CTL_DEL, cl.fd, nil)
+		delete(cl.loop.conns, cl.fd)
+	}
+	cl.out = nil
+	cl.TcpConn.Close()
+
+	if registered && cl.ConnCallback != nil {
+		// 关闭回调
+		cl.ConnCallback.OnDisconnected(cl)
+	}
+}
@@ -0,0 +1,36 @@
+//go:build !linux
+// +build !linux
+
+package server
+
+import (
+	"errors"
+	"github.com/golang/glog"
+	"net"
+	"xconn/common"
+	"xconn/tools"
+)
+
+/**
+ * @brief: 非linux平台不支持事件循环
+ */
+type eventLoop struct{}
+
+type EpollConn struct {
+	*TcpConn
+}
+
+func startEventLoops(n int)[]*eventLoop{
+	glog.Errorln("事件循环模式仅支持linux，使用默认模式")
+	return nil
+}
+
+func (l *eventLoop)stop()<-chan struct{}{
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+
+func newEpollConn(conn net.Conn, config *common.Config, workers *tools.WorkerPool, loop *eventLoop)(*EpollConn, error){
+	return nil, errors.New("event loop is only supported on linux")
+}
@@ -4,6 +4,7 @@ import (
 	"github.com/golang/glog"
 	"github.com/google/uuid"
 	"net"
+	"sync"
 	"time"
 	"xconn/common"
 	"xconn/tools"
@@ -14,33 +15,60 @@ import (
  */
 type UdpConn struct {
 	common.BaseConn
-	UdpAddr      *net.UDPAddr         // udp地址
-	Conn         *net.UDPConn         // 连接
+	UdpAddr      *net.UDPAddr         // udp地址，unixgram为nil；设置SessionKeyFunc时可能变化，需要通过GetUdpAddr获取
+	Conn         *net.UDPConn         // udp连接，unixgram为nil
+	PacketConn   net.PacketConn       // 连接，udp时与Conn相同
+	peer         net.Addr             // 对端地址
+	batchSize    int                  // 批量发送的最大数据报数
+	sessionKey   string               // 会话key，在服务端connMap中的key
+	group        string               // 最近收到的数据报的组播目的地址，单播数据为空
+	rudp         *tools.Rudp          // 可靠udp协议，Network为rudp时不为nil
+	rudpTimer    *tools.Timer         // 可靠udp重传定时任务
+	fragmenter   *tools.Fragmenter    // 发送分片，未开启分片时为nil，只在发送协程中使用
+	reassembler  *tools.Reassembler   // 接收分片重组，未开启分片时为nil
+	addrMu       sync.RWMutex         // 地址锁
 }
 
 
 
-func newUdpConn(conn *net.UDPConn, addr *net.UDPAddr, config *common.Config)*UdpConn {
+func newUdpConn(conn net.PacketConn, addr net.Addr, key string, config *common.Config, workers *tools.WorkerPool, budget *tools.ReassemblyBudget)*UdpConn {
 	localAddr := conn.LocalAddr().String()
 	addrstr := addr.String()
 	glog.Infoln(addrstr, localAddr)
 	ci := &UdpConn{
-		Conn:    conn,
-		UdpAddr: addr,
+		PacketConn: conn,
+		peer:       addr,
+		sessionKey: key,
 	}
+	ci.Conn, _ = conn.(*net.UDPConn)
+	ci.UdpAddr, _ = addr.(*net.UDPAddr)
 	ci.Id = uuid.New().String()
 	ci.RemoteAddress = addr.String()
 	ci.LocalAddr = conn.LocalAddr().String()
-	ci.Sender = tools.NewDataTransport(1, config.SendChanSize)
+	ci.Sender = common.NewSender(config)
 	ci.Done = make(chan bool, 1)
-	ci.TimeoutCheck = tools.NewTimeoutCheck(config.Interval, config.Timeout)
+	ci.TimeoutCheck = common.NewTimeoutCheck(config)
 	if config.BufSize <= 0{
 		config.BufSize = 1024
 	}
 	ci.RecvBufSize = config.BufSize
+	ci.batchSize = config.UdpBatchSize
 	ci.ConnCallback = config.ConnCallback
 	ci.Label = config.Label
+	ci.Heartbeat = config.Heartbeat
+	ci.HeartbeatInterval = config.Interval
 	ci.DataHandler = config.DataHandler
+	if workers != nil {
+		ci.Receiver = workers.NewTaskQueue(config.RecvChanSize, ci.handleDatagram, releaseBytes)
+		ci.RecvFullPolicy = config.RecvFullPolicy
+	}
+	if config.Network == "rudp" {
+		ci.rudp = tools.NewRudp(config.RudpMtu, config.RudpWindow, ci.rudpOutput)
+	} else if config.UdpFragmentSize > 0 {
+		// rudp自带分片
+		ci.fragmenter = tools.NewFragmenter(config.UdpFragmentSize)
+		ci.reassembler = tools.NewReassembler(config.UdpReassemblyTimeout, config.UdpReassemblyMaxBytes, budget)
+	}
 	ci.IConn = ci
 
 	return ci
@@ -54,13 +82,20 @@ func (cl *UdpConn)Start(){
 		}()
 
 		cl.startSendProcess()
+		cl.startRudpProcess()
 
 		if cl.ConnCallback != nil {
 			// 新连接回调
 			cl.ConnCallback.OnConnected(cl)
 		}
+		cl.StartHeartbeatProcess()
+		cl.StartTimeoutCheckProcess()
 
 		<-cl.Done
+		if cl.reassembler != nil {
+			// 归还共用的重组内存
+			cl.reassembler.Close()
+		}
 
 		if cl.ConnCallback != nil {
 			// 关闭回调
@@ -69,32 +104,260 @@ func (cl *UdpConn)Start(){
 	}()
 }
 
+/**
+ * @brief: 关闭，udp没有底层连接可关闭，直接结束会话
+ */
+func (cl *UdpConn)Close(){
+	cl.BaseConn.Close()
+	if cl.rudp != nil {
+		if cl.rudpTimer != nil {
+			cl.rudpTimer.Stop()
+		}
+		cl.rudp.Close()
+	}
+	cl.Finish()
+}
+
 /**
  * @brief: 发送处理流程
  */
 func (cl *UdpConn)startSendProcess() {
-	cl.Sender.Consume(func(data interface{}) bool {
-		if data != nil{
+	if cl.rudp != nil {
+		// 可靠udp由协议负责分段、重传，窗口已满时阻塞
+		cl.Sender.Consume(func(data interface{}) bool {
 			if bytess, ok := data.([]byte); ok{
-				cl.Conn.SetWriteDeadline(time.Now().Add(time.Second * 5))
-				if _, err := cl.Conn.WriteToUDP(bytess, cl.UdpAddr); err != nil {
-					glog.Errorln("conn.Write", err.Error())
-					cl.Done <- true
+				if err := cl.rudp.Send(bytess); err != nil {
+					glog.Errorln("rudp.Send", err.Error())
+					cl.Finish()
 					return false
 				}
 			}
+			return true
+		})
+		return
+	}
+
+	batch := newUdpBatch(cl.PacketConn, cl.batchSize, false)
+	datas := make([][]byte, 0, batch.size())
+	cl.Sender.Consume(func(data interface{}) bool {
+		if bytess, ok := data.([]byte); ok{
+			datas = cl.appendSend(datas, bytess)
+		}
+		// 合并队列中已有的数据，一次系统调用发送
+		for len(datas) < batch.size() {
+			next, ok := cl.Sender.Next()
+			if !ok {
+				break
+			}
+			if bytess, ok := next.([]byte); ok{
+				datas = cl.appendSend(datas, bytess)
+			}
+		}
+		if len(datas) == 0 {
+			return true
+		}
+
+		cl.PacketConn.SetWriteDeadline(time.Now().Add(time.Second * 5))
+		err := batch.write(datas, cl.GetPeerAddr())
+		for i := range datas {
+			datas[i] = nil
+		}
+		datas = datas[:0]
+		if err != nil {
+			glog.Errorln("conn.Write", err.Error())
+			cl.Finish()
+			return false
 		}
+		cl.TimeoutCheck.TickWrite()
 		return true
 	})
 }
 
+/**
+ * @brief: 获取对端udp地址，unixgram为nil
+ */
+func (cl *UdpConn)GetUdpAddr()*net.UDPAddr{
+	cl.addrMu.RLock()
+	defer cl.addrMu.RUnlock()
+	return cl.UdpAddr
+}
+
+/**
+ * @brief: 获取对端地址，udp为*net.UDPAddr，unixgram为*net.UnixAddr
+ */
+func (cl *UdpConn)GetPeerAddr()net.Addr{
+	cl.addrMu.RLock()
+	defer cl.addrMu.RUnlock()
+	return cl.peer
+}
+
+func (cl *UdpConn)GetRemoteAddr()string{
+	cl.addrMu.RLock()
+	defer cl.addrMu.RUnlock()
+	return cl.RemoteAddress
+}
+
+/**
+ * @brief: 获取最近收到的数据报的组播目的地址，单播数据或非组播监听时为空
+ * 在DataHandler中直接处理（WorkerCount<=0）时即为当前数据报的目的地址
+ */
+func (cl *UdpConn)GetGroup()string{
+	cl.addrMu.RLock()
+	defer cl.addrMu.RUnlock()
+	return cl.group
+}
+
+/**
+ * @brief: 记录数据报的目的地址
+ */
+func (cl *UdpConn)setGroup(dst net.IP){
+	group := ""
+	if dst != nil && dst.IsMulticast() {
+		group = dst.String()
+	}
+
+	cl.addrMu.Lock()
+	cl.group = group
+	cl.addrMu.Unlock()
+}
+
+/**
+ * @brief: 会话从新地址收到数据时更新地址，之后的数据发送到新地址
+ */
+func (cl *UdpConn)updateAddr(addr net.Addr){
+	cl.addrMu.Lock()
+	old := cl.RemoteAddress
+	if old == addr.String() {
+		cl.addrMu.Unlock()
+		return
+	}
+	cl.peer = addr
+	cl.UdpAddr, _ = addr.(*net.UDPAddr)
+	cl.RemoteAddress = addr.String()
+	cl.addrMu.Unlock()
+
+	glog.Infoln(cl.Label, "udp会话地址变化:", cl.sessionKey, old, "->", addr.String())
+	if h, ok := cl.ConnCallback.(common.AddressChangeHandler); ok {
+		h.OnAddressChanged(cl, old)
+	}
+}
+
+/**
+ * @brief: 加入待发送列表，开启分片时超长数据拆分为多个分片
+ */
+func (cl *UdpConn)appendSend(datas [][]byte, data []byte)[][]byte{
+	if cl.fragmenter == nil {
+		return append(datas, data)
+	}
+
+	frags := cl.fragmenter.Split(data)
+	if frags == nil {
+		glog.Errorln(cl.Label, cl.GetRemoteAddr(), "数据过大无法分片，丢弃", len(data))
+		return datas
+	}
+	return append(datas, frags...)
+}
+
+/**
+ * @brief: 可靠udp定时驱动重传、确认，链路断开时关闭连接
+ */
+func (cl *UdpConn)startRudpProcess(){
+	if cl.rudp == nil {
+		return
+	}
+
+	cl.rudpTimer = tools.DefaultTimingWheel().Every(tools.DefaultWheelTick, func() {
+		if err := cl.rudp.Update(); err == tools.ErrRudpDeadLink || err == tools.ErrRudpReset {
+			glog.Errorln(cl.Label, cl.GetRemoteAddr(), "rudp链路断开:", err.Error())
+			if cl.ConnCallback != nil {
+				cl.ConnCallback.OnError(cl, err)
+			}
+			// 时间轮协程中不能阻塞
+			go cl.Close()
+		}
+	})
+}
+
+/**
+ * @brief: 可靠udp输出数据报
+ */
+func (cl *UdpConn)rudpOutput(pkt []byte){
+	if _, err := cl.PacketConn.WriteTo(pkt, cl.GetPeerAddr()); err != nil {
+		glog.Errorln("conn.Write", err.Error())
+		return
+	}
+	cl.TimeoutCheck.TickWrite()
+}
+
+/**
+ * @brief: 处理收到的数据报，可靠udp先经过协议处理，按顺序交付完整消息
+ * @param1 data: 数据报，引用监听协程的接收缓冲区，返回后即被复用
+ */
 func (cl *UdpConn)recv(data []byte){
 	cl.TimeoutCheck.Tick()
 
-	if cl.DataHandler != nil{
+	if cl.rudp != nil {
+		err := cl.rudp.Input(data, cl.deliver)
+		if err == tools.ErrRudpReset {
+			// 对端已重启，关闭会话，对端重传的数据会创建新会话
+			glog.Errorln(cl.Label, cl.GetRemoteAddr(), "rudp对端已重启，关闭会话")
+			if cl.ConnCallback != nil {
+				cl.ConnCallback.OnError(cl, err)
+			}
+			cl.Finish()
+		} else if err != nil && err != tools.ErrRudpClosed {
+			glog.Errorln(cl.Label, cl.GetRemoteAddr(), "rudp数据错误:", err.Error())
+		}
+		return
+	}
+
+	if cl.reassembler != nil {
+		if !tools.IsFragment(data) {
+			glog.Errorln(cl.Label, cl.GetRemoteAddr(), "开启分片时收到没有分片头的数据报，丢弃", len(data))
+			return
+		}
+		msg, ok := cl.reassembler.Add(data)
+		if !ok {
+			return
+		}
+		data = msg
+	}
+	cl.deliver(data)
+}
+
+/**
+ * @brief: 交付数据给DataHandler
+ * @param1 data: 数据，返回后即被复用
+ */
+func (cl *UdpConn)deliver(data []byte){
+	cl.MatchPong(data)
+
+	if cl.DataHandler == nil{
+		glog.Errorln("udp conn data handler is nil")
+		return
+	}
+
+	if cl.Receiver == nil {
 		// udp
 		cl.DataHandler.Handle(data, cl)
-	}else{
-		glog.Errorln("udp conn data handler is nil")
+		return
+	}
+
+	// 放入接收队列前拷贝到池化缓冲区
+	buf := tools.GetBytes(len(data))
+	copy(buf, data)
+	if !cl.PushRecv(buf) {
+		cl.Finish()
 	}
 }
+
+/**
+ * @brief: 工作协程中处理数据报
+ * @param1 item: 池化的数据报，处理完成后归还
+ */
+func (cl *UdpConn)handleDatagram(item interface{}){
+	data := item.([]byte)
+	defer tools.PutBytes(data)
+
+	cl.DataHandler.Handle(data, cl)
+}
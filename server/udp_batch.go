@@ -0,0 +1,145 @@
+package server
+
+import (
+	"golang.org/x/net/ipv4"
+	"net"
+	"xconn/tools"
+)
+
+/**
+ * @brief: 批量收发接口，ipv4.PacketConn、ipv6.PacketConn都实现了该接口
+ */
+type batchPacketConn interface {
+	ReadBatch(ms []ipv4.Message, flags int)(int, error)
+	WriteBatch(ms []ipv4.Message, flags int)(int, error)
+}
+
+/**
+ * @brief: udp批量收发，linux使用recvmmsg/sendmmsg，其他平台、unixgram或批量大小为1时逐个收发
+ * 不能在多个协程中同时使用，每个接收协程、发送协程各自创建
+ */
+type udpBatch struct {
+	conn net.PacketConn
+	pc   batchPacketConn // 为nil时逐个收发
+	bufs [][]byte        // 接收缓冲区，池化
+	ms   []ipv4.Message
+	mc   *udpMulticast   // 不为nil时为组播socket，逐个接收并读取目的地址
+}
+
+/**
+ * @brief: 创建批量收发
+ * @param1 conn: socket
+ * @param2 size: 单次收发的最大数据报数，<=1时逐个收发
+ * @param3 read: 是否用于接收，接收时分配缓冲区
+ */
+func newUdpBatch(conn net.PacketConn, size int, read bool)*udpBatch{
+	if size <= 0 {
+		size = 1
+	}
+
+	b := &udpBatch{conn: conn}
+	if uc, ok := conn.(*net.UDPConn); ok && size > 1 {
+		b.pc = newBatchPacketConn(uc)
+	}
+	if b.pc == nil {
+		size = 1
+	}
+	b.ms = make([]ipv4.Message, size)
+	if read {
+		b.bufs = make([][]byte, size)
+		for i := range b.bufs {
+			b.bufs[i] = tools.GetBytes(65535)
+			b.ms[i].Buffers = [][]byte{b.bufs[i]}
+		}
+	}
+	return b
+}
+
+/**
+ * @brief: 归还接收缓冲区
+ */
+func (b *udpBatch)release(){
+	for i := range b.bufs {
+		tools.PutBytes(b.bufs[i])
+	}
+	b.bufs = nil
+}
+
+/**
+ * @brief: 接收一批数据报
+ * @param1 f: 逐个处理数据报，data引用接收缓冲区，f返回后即被覆盖；addr为来源地址，未绑定地址的unixgram对端为nil；dst为目的地址，只有组播socket读取
+ */
+func (b *udpBatch)read(f func(data []byte, addr net.Addr, dst net.IP))error{
+	if b.mc != nil {
+		n, dst, addr, err := b.mc.read(b.bufs[0])
+		if err != nil {
+			return err
+		}
+		if n > 0 && addr != nil {
+			f(b.bufs[0][:n], addr, dst)
+		}
+		return nil
+	}
+
+	if b.pc == nil {
+		n, addr, err := b.conn.ReadFrom(b.bufs[0])
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			f(b.bufs[0][:n], addr, nil)
+		}
+		return nil
+	}
+
+	n, err := b.pc.ReadBatch(b.ms, 0)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		if b.ms[i].N <= 0 {
+			continue
+		}
+		f(b.bufs[i][:b.ms[i].N], b.ms[i].Addr, nil)
+	}
+	return nil
+}
+
+/**
+ * @brief: 发送一批数据报到同一地址，批量大小超过size时分多次发送
+ */
+func (b *udpBatch)write(datas [][]byte, addr net.Addr)error{
+	if b.pc == nil {
+		for _, data := range datas {
+			if _, err := b.conn.WriteTo(data, addr); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for len(datas) > 0 {
+		ms := b.ms
+		if len(datas) < len(ms) {
+			ms = ms[:len(datas)]
+		}
+		for i := range ms {
+			ms[i].Buffers = [][]byte{datas[i]}
+			ms[i].Addr = addr
+		}
+		n, err := b.pc.WriteBatch(ms, 0)
+		if err != nil {
+			return err
+		}
+		// sendmmsg可能只发送一部分
+		datas = datas[n:]
+	}
+	return nil
+}
+
+/**
+ * @brief: 发送批量大小
+ */
+func (b *udpBatch)size()int{
+	return len(b.ms)
+}
@@ -0,0 +1,17 @@
+package server
+
+import (
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"net"
+)
+
+/**
+ * @brief: linux下ReadBatch/WriteBatch使用recvmmsg/sendmmsg
+ */
+func newBatchPacketConn(conn *net.UDPConn)batchPacketConn{
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil && len(addr.IP) == net.IPv6len {
+		return ipv6.NewPacketConn(conn)
+	}
+	return ipv4.NewPacketConn(conn)
+}
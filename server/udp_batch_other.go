@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package server
+
+import (
+	"net"
+)
+
+/**
+ * @brief: 非linux平台没有recvmmsg/sendmmsg，逐个收发
+ */
+func newBatchPacketConn(conn *net.UDPConn)batchPacketConn{
+	return nil
+}
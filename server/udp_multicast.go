@@ -0,0 +1,174 @@
+package server
+
+import (
+	"errors"
+	"github.com/golang/glog"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"net"
+	"sync"
+	"xconn/common"
+	"xconn/tools"
+)
+
+/**
+ * @brief: udp组播，加入组播组并读取数据报的目的地址
+ */
+type udpMulticast struct {
+	p4 *ipv4.PacketConn // ipv4组播，p4、p6只有一个不为nil
+	p6 *ipv6.PacketConn // ipv6组播
+	fragmenter *tools.Fragmenter // 开启分片时发送组播数据的分片，未开启时为nil
+	fragMu     sync.Mutex        // 分片锁，SendMulticast可能在多个协程中调用
+}
+
+/**
+ * @brief: 监听组播，按配置加入组播组并设置TTL、回环
+ * 绑定通配地址，绑定单播地址时收不到组播数据；同时也接收该端口的单播数据
+ * @param1 config: 配置，MulticastGroups不能为空，所有组播地址需要是同一地址族
+ */
+func listenMulticast(config *common.Config)(*net.UDPConn, *udpMulticast, error){
+	groups := make([]net.IP, 0, len(config.MulticastGroups))
+	v6 := false
+	for i, g := range config.MulticastGroups {
+		ip := net.ParseIP(g)
+		if ip == nil || !ip.IsMulticast() {
+			return nil, nil, errors.New("invalid multicast group: " + g)
+		}
+		if i > 0 && v6 != (ip.To4() == nil) {
+			return nil, nil, errors.New("multicast groups must be the same address family")
+		}
+		v6 = ip.To4() == nil
+		groups = append(groups, ip)
+	}
+
+	ifis := []*net.Interface{nil}
+	if len(config.MulticastInterfaces) > 0 {
+		ifis = ifis[:0]
+		for _, name := range config.MulticastInterfaces {
+			ifi, err := net.InterfaceByName(name)
+			if err != nil {
+				return nil, nil, err
+			}
+			ifis = append(ifis, ifi)
+		}
+	}
+
+	network := "udp4"
+	if v6 {
+		network = "udp6"
+	}
+	conn, err := net.ListenUDP(network, &net.UDPAddr{Port: config.Port})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	mc := &udpMulticast{}
+	if config.UdpFragmentSize > 0 {
+		// 接收端按分片解析，组播数据也要带分片头
+		mc.fragmenter = tools.NewFragmenter(config.UdpFragmentSize)
+	}
+	if v6 {
+		mc.p6 = ipv6.NewPacketConn(conn)
+		err = mc.setup6(groups, ifis, config)
+	} else {
+		mc.p4 = ipv4.NewPacketConn(conn)
+		err = mc.setup4(groups, ifis, config)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, mc, nil
+}
+
+func (mc *udpMulticast)setup4(groups []net.IP, ifis []*net.Interface, config *common.Config)error{
+	for _, ifi := range ifis {
+		for _, g := range groups {
+			if err := mc.p4.JoinGroup(ifi, &net.UDPAddr{IP: g}); err != nil {
+				return err
+			}
+		}
+	}
+	if ifis[0] != nil {
+		// 发送使用第一个网卡
+		if err := mc.p4.SetMulticastInterface(ifis[0]); err != nil {
+			return err
+		}
+	}
+	ttl := config.MulticastTTL
+	if ttl <= 0 {
+		ttl = 1
+	}
+	if err := mc.p4.SetMulticastTTL(ttl); err != nil {
+		return err
+	}
+	if err := mc.p4.SetMulticastLoopback(config.MulticastLoopback); err != nil {
+		return err
+	}
+	if err := mc.p4.SetControlMessage(ipv4.FlagDst, true); err != nil {
+		// 部分平台不支持，GetGroup返回空
+		glog.Warningln("无法读取组播目的地址:", err.Error())
+	}
+	return nil
+}
+
+func (mc *udpMulticast)setup6(groups []net.IP, ifis []*net.Interface, config *common.Config)error{
+	for _, ifi := range ifis {
+		for _, g := range groups {
+			if err := mc.p6.JoinGroup(ifi, &net.UDPAddr{IP: g}); err != nil {
+				return err
+			}
+		}
+	}
+	if ifis[0] != nil {
+		if err := mc.p6.SetMulticastInterface(ifis[0]); err != nil {
+			return err
+		}
+	}
+	hops := config.MulticastTTL
+	if hops <= 0 {
+		hops = 1
+	}
+	if err := mc.p6.SetMulticastHopLimit(hops); err != nil {
+		return err
+	}
+	if err := mc.p6.SetMulticastLoopback(config.MulticastLoopback); err != nil {
+		return err
+	}
+	if err := mc.p6.SetControlMessage(ipv6.FlagDst, true); err != nil {
+		// 部分平台不支持，GetGroup返回空
+		glog.Warningln("无法读取组播目的地址:", err.Error())
+	}
+	return nil
+}
+
+/**
+ * @brief: 读取数据报及其目的地址
+ * @return2: 目的地址，组播数据为组播地址
+ */
+func (mc *udpMulticast)read(buf []byte)(int, net.IP, *net.UDPAddr, error){
+	var (
+		n   int
+		dst net.IP
+		src net.Addr
+		err error
+	)
+	if mc.p4 != nil {
+		var cm *ipv4.ControlMessage
+		n, cm, src, err = mc.p4.ReadFrom(buf)
+		if cm != nil {
+			dst = cm.Dst
+		}
+	} else {
+		var cm *ipv6.ControlMessage
+		n, cm, src, err = mc.p6.ReadFrom(buf)
+		if cm != nil {
+			dst = cm.Dst
+		}
+	}
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	addr, _ := src.(*net.UDPAddr)
+	return n, dst, addr, nil
+}
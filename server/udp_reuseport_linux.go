@@ -0,0 +1,31 @@
+package server
+
+import (
+	"context"
+	"golang.org/x/sys/unix"
+	"net"
+	"syscall"
+)
+
+/**
+ * @brief: 以SO_REUSEPORT方式监听udp，多个socket绑定同一端口，由内核按地址哈希分发数据报
+ */
+func listenUdpReusePort(network, address string)(*net.UDPConn, error){
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return serr
+		},
+	}
+	pc, err := lc.ListenPacket(context.Background(), network, address)
+	if err != nil {
+		return nil, err
+	}
+	return pc.(*net.UDPConn), nil
+}
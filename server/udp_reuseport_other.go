@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package server
+
+import (
+	"errors"
+	"net"
+)
+
+/**
+ * @brief: 非linux平台不支持SO_REUSEPORT
+ */
+func listenUdpReusePort(network, address string)(*net.UDPConn, error){
+	return nil, errors.New("SO_REUSEPORT is only supported on linux")
+}
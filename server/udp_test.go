@@ -0,0 +1,113 @@
+package server
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"xconn/common"
+)
+
+type echoHandler struct{}
+
+func (echoHandler) Handle(data []byte, conn common.IConn) ([]byte, error) {
+	conn.Send(append([]byte(nil), data...))
+	return nil, nil
+}
+
+func startPacketServer(t *testing.T, config *common.Config) *Server {
+	config.DataHandler = echoHandler{}
+	s := NewServer(config)
+	s.Start()
+	if len(s.udpConns) == 0 {
+		t.Fatal("listen failed")
+	}
+	return s
+}
+
+func packetRoundTrip(t *testing.T, c net.PacketConn, addr net.Addr) {
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 64)
+	for _, msg := range []string{"hello", "world"} {
+		if _, err := c.WriteTo([]byte(msg), addr); err != nil {
+			t.Fatal(err)
+		}
+		n, _, err := c.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != msg {
+			t.Fatalf("got %q, want %q", buf[:n], msg)
+		}
+	}
+}
+
+// an unbound unixgram peer cannot be replied to, so the peer binds its own path
+func unixgramRoundTrip(t *testing.T, path string) {
+	peer := filepath.Join(t.TempDir(), "c.sock")
+	c, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: peer, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	packetRoundTrip(t, c, &net.UnixAddr{Name: path, Net: "unixgram"})
+}
+
+func TestUnixgramRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "s.sock")
+
+	// a crashed server leaves its socket file behind
+	l, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Skip("unixgram not supported:", err)
+	}
+	l.Close()
+	if _, err := os.Lstat(path); err != nil {
+		t.Fatal("closed unixgram socket file removed:", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		s := startPacketServer(t, &common.Config{Network: "unixgram", Ip: path})
+		unixgramRoundTrip(t, path)
+		s.Stop()
+		if _, err := os.Lstat(path); !os.IsNotExist(err) {
+			t.Fatalf("run %d: socket file left after Stop: %v", i, err)
+		}
+	}
+}
+
+func TestRemoveStaleUnixgram(t *testing.T) {
+	dir := t.TempDir()
+	live := filepath.Join(dir, "live.sock")
+	l, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: live, Net: "unixgram"})
+	if err != nil {
+		t.Skip("unixgram not supported:", err)
+	}
+	defer l.Close()
+	removeStaleUnixgram(live)
+	if _, err := os.Lstat(live); err != nil {
+		t.Fatal("socket in use removed")
+	}
+
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	removeStaleUnixgram(file)
+	if _, err := os.Lstat(file); err != nil {
+		t.Fatal("regular file removed")
+	}
+}
+
+func TestUdp6RoundTrip(t *testing.T) {
+	c, err := net.ListenPacket("udp6", "[::1]:0")
+	if err != nil {
+		t.Skip("ipv6 loopback not available:", err)
+	}
+	defer c.Close()
+
+	s := startPacketServer(t, &common.Config{Network: "udp6", Ip: "::1"})
+	defer s.Stop()
+	packetRoundTrip(t, c, s.udpConns[0].LocalAddr())
+}
@@ -1,10 +1,16 @@
 package server
 
 import (
+	"errors"
 	"github.com/golang/glog"
 	"github.com/google/uuid"
-	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 	"xconn/common"
 	"xconn/tools"
@@ -16,36 +22,196 @@ import (
 type WsConn struct {
 	common.BaseConn
 	conn         *websocket.Conn      // 连接
-	ginCtx       *gin.Context         // 当前连接上下文
+	request      *http.Request        // 升级请求
+	route        *wsRoute             // 所属路由
 	path         string               // 连接对应路径
-	msgType      int                  // 消息类型
+	msgType      int                  // 消息类型，Send使用
+	recvDone     chan struct{}        // 接收协程结束时关闭
+	closeCode    int                  // 对端关闭码
+	closeText    string               // 对端关闭原因
+	closeMu      sync.Mutex           // 关闭码锁
+	readLimit    int64                // 单个消息最大长度，<=0不限制
+	closeSent    int32                // 是否已发送关闭帧，每个连接只发送一次
 }
 
+const (
+	wsCloseWait = time.Second // CloseWithCode等待对端回复关闭帧的时间
+	wsStreamChunk = 32 * 1024 // 流式发送每次读取的长度
+)
+
+var errWsMessageTooBig = errors.New("websocket: message too big")
+
+/**
+ * @brief: 流式发送的消息
+ */
+type wsStream struct {
+	msgType int
+	reader  io.Reader
+}
+
+/**
+ * @brief: 限制消息长度的reader，超过长度时返回errWsMessageTooBig
+ */
+type wsLimitReader struct {
+	r        io.Reader
+	remain   int64 // 剩余可读长度
+	exceeded bool  // 是否已超过长度
+}
+
+func (lr *wsLimitReader)Read(p []byte)(int, error){
+	if lr.exceeded {
+		return 0, errWsMessageTooBig
+	}
+	// 多读一个字节用于判断是否超过长度
+	if int64(len(p)) > lr.remain + 1 {
+		p = p[:lr.remain + 1]
+	}
+	n, err := lr.r.Read(p)
+	if int64(n) > lr.remain {
+		n = int(lr.remain)
+		lr.remain = 0
+		lr.exceeded = true
+		return n, errWsMessageTooBig
+	}
+	lr.remain -= int64(n)
+	return n, err
+}
+
+/**
+ * @brief: 指定类型的ws消息，发送队列、接收队列中使用
+ */
+type wsMessage struct {
+	msgType int
+	data    []byte
+}
+
+/**
+ * @brief: 共享的ws写缓冲池，WsWriteBufferPool为true时使用
+ */
+var wsWriteBufferPool = &sync.Pool{}
+
+/**
+ * @brief: 根据配置创建ws upgrader
+ */
+func newWsUpgrader(config *common.Config)websocket.Upgrader{
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:    config.WsReadBufferSize,
+		WriteBufferSize:   config.WsWriteBufferSize,
+		HandshakeTimeout:  config.WsHandshakeTimeout,
+		Subprotocols:      config.WsSubprotocols,
+		EnableCompression: config.WsEnableCompression,
+		CheckOrigin:       wsCheckOrigin(config.WsAllowedOrigins),
+	}
+	if upgrader.ReadBufferSize <= 0 {
+		upgrader.ReadBufferSize = 4096
+	}
+	if upgrader.WriteBufferSize <= 0 {
+		upgrader.WriteBufferSize = 4096
+	}
+	if upgrader.HandshakeTimeout <= 0 {
+		upgrader.HandshakeTimeout = 5 * time.Second
+	}
+	if config.WsWriteBufferPool {
+		upgrader.WriteBufferPool = wsWriteBufferPool
+	}
+	return upgrader
+}
+
+/**
+ * @brief: Origin校验，允许列表为空时返回nil，使用websocket默认的同源校验
+ * @param1 origins: 允许的Origin，可以是完整Origin（scheme://host[:port]）或者host[:port]，"*"允许所有
+ */
+func wsCheckOrigin(origins []string)func(r *http.Request)bool{
+	if len(origins) == 0 {
+		return nil
+	}
+
+	allowed := make(map[string]bool, len(origins))
+	for _, origin := range origins {
+		if origin == "*" {
+			return func(r *http.Request) bool {
+				return true
+			}
+		}
+		allowed[strings.ToLower(origin)] = true
+	}
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			// 非浏览器客户端
+			return true
+		}
+		origin = strings.ToLower(origin)
+		if allowed[origin] {
+			return true
+		}
+		u, err := url.Parse(origin)
+		if err != nil {
+			return false
+		}
+		return allowed[u.Host]
+	}
+}
 
-func newWsConn(conn *websocket.Conn, ctx *gin.Context, config *common.Config, path, wsMsgType string)*WsConn {
+
+func newWsConn(conn *websocket.Conn, req *http.Request, route *wsRoute, workers *tools.WorkerPool)*WsConn {
+	config := route.config
 	msgType := 0
-	if wsMsgType == "text" {
+	if route.msgType == "text" {
 		msgType = websocket.TextMessage
 	} else {
 		msgType = websocket.BinaryMessage
 	}
 	ci := &WsConn{
 		conn:    conn,
-		ginCtx:  ctx,
-		path:    path,
+		request: req,
+		route:   route,
+		path:    route.path,
 		msgType: msgType,
+		recvDone: make(chan struct{}),
+		readLimit: config.WsReadLimit,
 	}
 	ci.Id = uuid.New().String()
-	ci.Sender = tools.NewDataTransport(1, config.SendChanSize)
+	if config.WsReadLimit > 0 {
+		conn.SetReadLimit(config.WsReadLimit)
+	}
+	if config.WsEnableCompression && config.WsCompressionLevel != 0 {
+		if err := conn.SetCompressionLevel(config.WsCompressionLevel); err != nil {
+			glog.Errorln("ws压缩级别无效:", config.WsCompressionLevel, err.Error())
+		}
+	}
+	ci.Sender = common.NewSender(config)
 	ci.Done = make(chan bool, 1)
-	ci.TimeoutCheck = tools.NewTimeoutCheck(config.Interval, config.Timeout)
+	ci.TimeoutCheck = common.NewTimeoutCheck(config)
 	if config.BufSize <= 0{
 		config.BufSize = 1024
 	}
 	ci.RecvBufSize = config.BufSize
 	ci.ConnCallback = config.ConnCallback
 	ci.Label = config.Label
+	ci.Heartbeat = config.Heartbeat
+	if ci.Heartbeat == nil {
+		ci.Heartbeat = wsPingProvider{}
+	}
+	ci.HeartbeatInterval = config.Interval
+	conn.SetPongHandler(func(string) error {
+		ci.TimeoutCheck.Tick()
+		ci.OnPong()
+		return nil
+	})
+	conn.SetCloseHandler(func(code int, text string) error {
+		// 记录对端关闭码，未发送过关闭帧时回复同样的关闭码
+		ci.closeMu.Lock()
+		ci.closeCode, ci.closeText = code, text
+		ci.closeMu.Unlock()
+		ci.writeClose(code, "", time.Now().Add(time.Second))
+		return nil
+	})
 	ci.DataHandler = config.DataHandler
+	if workers != nil {
+		ci.Receiver = workers.NewTaskQueue(config.RecvChanSize, ci.handleMessage, nil)
+		ci.RecvFullPolicy = config.RecvFullPolicy
+	}
 	ci.RemoteAddress = conn.RemoteAddr().String()
 	ci.LocalAddr = conn.LocalAddr().String()
 	ci.IConn = ci
@@ -70,6 +236,8 @@ func (cl *WsConn)Start() {
 			// 新连接回调
 			cl.ConnCallback.OnConnected(cl)
 		}
+		cl.StartHeartbeatProcess()
+		cl.StartTimeoutCheckProcess()
 
 		<-cl.Done
 
@@ -80,24 +248,166 @@ func (cl *WsConn)Start() {
 	}()
 }
 
+/**
+ * @brief: 关闭，未发送过关闭帧时尽量发送1000关闭帧，之后关闭底层连接，不等待对端回复
+ */
 func (cl *WsConn)Close(){
-	cl.Close()
+	cl.BaseConn.Close()
 
 	if cl.conn != nil{
+		// 对端已关闭时直接返回错误
+		cl.writeClose(websocket.CloseNormalClosure, "", time.Now().Add(100 * time.Millisecond))
 		cl.conn.Close()
 	}
 }
 
+/**
+ * @brief: 发送关闭帧，已发送过时不再发送
+ * @return1: 是否已发送
+ */
+func (cl *WsConn)writeClose(code int, reason string, deadline time.Time)(bool, error){
+	if !atomic.CompareAndSwapInt32(&cl.closeSent, 0, 1) {
+		return false, nil
+	}
+	return true, cl.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), deadline)
+}
+
+/**
+ * @brief: 发送关闭帧，等待对端回复关闭帧或者超时后关闭连接，不阻塞调用方；已发送过关闭帧时忽略
+ * @param1 code: 关闭码，例如websocket.CloseNormalClosure、websocket.ClosePolicyViolation
+ * @param2 reason: 关闭原因，不超过123字节
+ */
+func (cl *WsConn)CloseWithCode(code int, reason string){
+	sent, err := cl.writeClose(code, reason, time.Now().Add(time.Second))
+	if !sent {
+		// 已经在关闭中
+		return
+	}
+	if err != nil {
+		glog.Errorln(cl.Label, cl.RemoteAddress, "发送关闭帧失败:", err.Error())
+		cl.Close()
+		return
+	}
+
+	go func() {
+		select {
+		case <-cl.recvDone:
+		case <-time.After(wsCloseWait):
+		}
+		cl.Close()
+	}()
+}
+
+/**
+ * @brief: 获取对端关闭码，连接断开后（OnDisconnected中）有效
+ * @return1: 关闭码，未收到关闭帧时为1006（websocket.CloseAbnormalClosure），消息超过WsReadLimit时为1009，连接未断开时为0
+ * @return2: 关闭原因
+ */
+func (cl *WsConn)GetCloseCode()(int, string){
+	cl.closeMu.Lock()
+	defer cl.closeMu.Unlock()
+	return cl.closeCode, cl.closeText
+}
+
+/**
+ * @brief: 发送文本消息
+ */
+func (cl *WsConn)SendText(data []byte){
+	cl.SendMessage(websocket.TextMessage, data, common.PriorityNormal)
+}
+
+/**
+ * @brief: 发送二进制消息
+ */
+func (cl *WsConn)SendBinary(data []byte){
+	cl.SendMessage(websocket.BinaryMessage, data, common.PriorityNormal)
+}
+
+/**
+ * @brief: 流式发送消息，按写缓冲区大小分为多个帧发送，不在内存中缓存整个消息
+ * 在发送协程中读取r，读取完成后如果r实现了io.Closer则关闭；读取出错时消息无法完整发送，关闭连接
+ * @param1 r: 消息内容，消息类型为路径对应的消息类型
+ */
+func (cl *WsConn)SendStream(r io.Reader){
+	cl.SendStreamMessage(cl.msgType, r, common.PriorityNormal)
+}
+
+/**
+ * @brief: 按指定类型、优先级流式发送消息，见SendStream
+ */
+func (cl *WsConn)SendStreamMessage(msgType int, r io.Reader, level int){
+	if r == nil{
+		glog.Errorln("发送数据位nil")
+		return
+	}
+	cl.Sender.Produce(wsStream{msgType: msgType, reader: r}, level)
+}
+
+/**
+ * @brief: 按指定类型、优先级发送消息，Send使用路径对应的消息类型
+ * @param1 msgType: 消息类型，websocket.TextMessage或者websocket.BinaryMessage
+ * @param2 data: 数据
+ * @param3 level: 优先级
+ */
+func (cl *WsConn)SendMessage(msgType int, data []byte, level int){
+	if data == nil{
+		glog.Errorln("发送数据位nil")
+		return
+	}
+	cl.Sender.Produce(wsMessage{msgType: msgType, data: data}, level)
+}
+
 /**
  * @brief: 获取查询参数值
  * @param1 key: 参数名称
  * @return1: 返回值
  */
 func (cl *WsConn)GetQuery(key string)string{
-	if key == "" || cl.ginCtx == nil{
+	if key == "" || cl.request == nil{
+		return ""
+	}
+	return cl.request.URL.Query().Get(key)
+}
+
+/**
+ * @brief: 获取升级请求的header
+ * @param1 key: header名称
+ */
+func (cl *WsConn)GetHeader(key string)string{
+	if cl.request == nil{
 		return ""
 	}
-	return cl.ginCtx.DefaultQuery(key, "")
+	return cl.request.Header.Get(key)
+}
+
+/**
+ * @brief: 获取升级请求的cookie
+ * @param1 name: cookie名称
+ * @return1: cookie值，不存在时为空
+ */
+func (cl *WsConn)GetCookie(name string)string{
+	if cl.request == nil{
+		return ""
+	}
+	cookie, err := cl.request.Cookie(name)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+/**
+ * @brief: 获取升级请求
+ */
+func (cl *WsConn)GetRequest()*http.Request{
+	return cl.request
+}
+
+/**
+ * @brief: 获取协商的子协议，未协商时为空
+ */
+func (cl *WsConn)Subprotocol()string{
+	return cl.conn.Subprotocol()
 }
 
 /**
@@ -112,15 +422,30 @@ func (cl *WsConn)GetPath()string{
  */
 func (cl *WsConn)startSendProcess() {
 	cl.Sender.Consume(func(data interface{}) bool {
+		if stream, ok := data.(wsStream); ok{
+			if err := cl.writeStream(stream); err != nil {
+				glog.Errorln("conn.Write stream", err.Error())
+				cl.Finish()
+				return false
+			}
+			cl.TimeoutCheck.TickWrite()
+			return true
+		}
 		if data != nil{
-			if bytess, ok := data.([]byte); ok{
+			msg, ok := data.(wsMessage)
+			if !ok {
+				bytess, _ := data.([]byte)
+				msg = wsMessage{msgType: cl.msgType, data: bytess}
+			}
+			if msg.data != nil{
 				cl.conn.SetWriteDeadline(time.Now().Add(time.Second * 5))
-				if err := cl.conn.WriteMessage(cl.msgType, bytess); err != nil {
+				if err := cl.conn.WriteMessage(msg.msgType, msg.data); err != nil {
 					glog.Errorln("conn.Write", err.Error())
-					cl.Done <- true
+					cl.Finish()
 					return false
 				}else{
 					//glog.Infoln("-------------->发送成功")
+					cl.TimeoutCheck.TickWrite()
 				}
 			}
 		}
@@ -129,18 +454,89 @@ func (cl *WsConn)startSendProcess() {
 }
 
 
+/**
+ * @brief: 流式写入一个消息，每次写入前更新写超时
+ */
+func (cl *WsConn)writeStream(stream wsStream)error{
+	if closer, ok := stream.reader.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	cl.conn.SetWriteDeadline(time.Now().Add(time.Second * 5))
+	w, err := cl.conn.NextWriter(stream.msgType)
+	if err != nil {
+		return err
+	}
+	buf := tools.GetBytes(wsStreamChunk)
+	defer tools.PutBytes(buf)
+	for {
+		n, rerr := stream.reader.Read(buf)
+		if n > 0 {
+			cl.conn.SetWriteDeadline(time.Now().Add(time.Second * 5))
+			if _, err := w.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			// 不关闭writer，避免把不完整的数据作为完整消息发出
+			return rerr
+		}
+	}
+	return w.Close()
+}
+
 /**
  * @brief: 接收处理流程
  */
 func (cl *WsConn)startRecvProcess() {
 	go func() {
 		defer func() {
-			cl.Done <- true
+			close(cl.recvDone)
+			cl.Finish()
 		}()
 
+		streamHandler, _ := cl.DataHandler.(common.WsStreamHandler)
 		for {
-			_, data, err := cl.conn.ReadMessage() // 读取数据
+			msgType, r, err := cl.conn.NextReader() // 读取数据
+			if err == nil && cl.readLimit > 0 {
+				// 压缩时底层只能限制压缩后的帧长度
+				r = &wsLimitReader{r: r, remain: cl.readLimit}
+			}
+			if err == nil && streamHandler != nil {
+				cl.TimeoutCheck.Tick()
+				herr := streamHandler.HandleStream(msgType, r, cl)
+				if herr != nil && !errors.Is(herr, errWsMessageTooBig) && !errors.Is(herr, websocket.ErrReadLimit) {
+					glog.Errorln(cl.Label, cl.RemoteAddress, "处理消息错误:", herr.Error())
+					if cl.ConnCallback != nil {
+						cl.ConnCallback.OnError(cl, herr)
+					}
+				}
+				if lr, ok := r.(*wsLimitReader); ok && lr.exceeded {
+					herr = errWsMessageTooBig
+				}
+				// 处理器没有读到超限的位置时，由下一次NextReader返回ErrReadLimit
+				if cl.tooBig(herr) {
+					break
+				}
+				continue
+			}
+
+			var data []byte
+			if err == nil {
+				data, err = io.ReadAll(r)
+			}
+			if cl.tooBig(err) {
+				break
+			}
 			if err != nil {
+				cl.setCloseCode(err)
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					glog.Infoln(cl.Label, cl.RemoteAddress, "对端关闭:", err.Error())
+					break
+				}
 				glog.Errorln(cl.Label, "读取客户端数据错误:", err.Error())
 				if cl.ConnCallback != nil {
 					// 新连接回调
@@ -151,13 +547,98 @@ func (cl *WsConn)startRecvProcess() {
 
 			// 处理数据
 			cl.TimeoutCheck.Tick()
+			cl.MatchPong(data)
 			// websocket 不需要处理粘包问题
-			if cl.DataHandler != nil{
-				cl.DataHandler.Handle(data, cl)
-			}else{
+			if cl.DataHandler == nil{
 				glog.Errorln("udp conn data handler is nil")
+				continue
+			}
+			if cl.Receiver == nil {
+				cl.dispatch(msgType, data)
+			} else if !cl.PushRecv(wsMessage{msgType: msgType, data: data}) {
+				break
 			}
 		}
 	}()
 }
 
+/**
+ * @brief: 是否为消息超过长度的错误，是时以1009关闭连接
+ * 底层的SetReadLimit超限时websocket已发送1009关闭帧并返回ErrReadLimit，不再发送
+ */
+func (cl *WsConn)tooBig(err error)bool{
+	switch {
+	case errors.Is(err, websocket.ErrReadLimit):
+		atomic.StoreInt32(&cl.closeSent, 1)
+	case errors.Is(err, errWsMessageTooBig):
+	default:
+		return false
+	}
+	cl.closeTooBig()
+	return true
+}
+
+/**
+ * @brief: 消息超过长度时以1009关闭连接，已发送过关闭帧时只记录关闭码
+ */
+func (cl *WsConn)closeTooBig(){
+	glog.Errorln(cl.Label, cl.RemoteAddress, "消息超过长度限制，关闭连接", cl.readLimit)
+	cl.closeMu.Lock()
+	cl.closeCode, cl.closeText = websocket.CloseMessageTooBig, errWsMessageTooBig.Error()
+	cl.closeMu.Unlock()
+
+	cl.writeClose(websocket.CloseMessageTooBig, "", time.Now().Add(time.Second))
+	if cl.ConnCallback != nil {
+		cl.ConnCallback.OnError(cl, errWsMessageTooBig)
+	}
+}
+
+/**
+ * @brief: 记录对端关闭码
+ */
+func (cl *WsConn)setCloseCode(err error){
+	code, text := websocket.CloseAbnormalClosure, err.Error()
+	if ce, ok := err.(*websocket.CloseError); ok {
+		code, text = ce.Code, ce.Text
+	}
+
+	cl.closeMu.Lock()
+	cl.closeCode, cl.closeText = code, text
+	cl.closeMu.Unlock()
+}
+
+/**
+ * @brief: 交给DataHandler处理，实现了WsMessageHandler时带上消息类型
+ */
+func (cl *WsConn)dispatch(msgType int, data []byte){
+	if h, ok := cl.DataHandler.(common.WsMessageHandler); ok {
+		h.HandleMessage(msgType, data, cl)
+		return
+	}
+	cl.DataHandler.Handle(data, cl)
+}
+
+/**
+ * @brief: 工作协程中处理消息
+ */
+func (cl *WsConn)handleMessage(item interface{}){
+	msg := item.(wsMessage)
+	cl.dispatch(msg.msgType, msg.data)
+}
+
+/**
+ * @brief: ws默认主动心跳，直接发送ping控制帧，不经过发送队列，回复由pong handler处理
+ */
+type wsPingProvider struct{}
+
+func (p wsPingProvider)Ping(conn common.IConn)[]byte{
+	if cl, ok := conn.(*WsConn); ok {
+		err := cl.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second * 5))
+		if err != nil {
+			glog.Errorln("conn.WriteControl ping", err.Error())
+		} else {
+			cl.TimeoutCheck.TickWrite()
+		}
+	}
+	return nil
+}
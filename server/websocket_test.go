@@ -0,0 +1,602 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/gorilla/websocket"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"xconn/common"
+)
+
+const wsTestTimeout = 5 * time.Second
+
+type wsTestCallback struct {
+	connected    chan common.IConn
+	disconnected chan common.IConn
+}
+
+func newWsTestCallback() *wsTestCallback {
+	return &wsTestCallback{
+		connected:    make(chan common.IConn, 16),
+		disconnected: make(chan common.IConn, 16),
+	}
+}
+
+func (cb *wsTestCallback) OnConnected(conn common.IConn)    { cb.connected <- conn }
+func (cb *wsTestCallback) OnDisconnected(conn common.IConn) { cb.disconnected <- conn }
+func (cb *wsTestCallback) OnError(common.IConn, error)      {}
+
+func waitConn(t *testing.T, ch chan common.IConn) *WsConn {
+	t.Helper()
+	select {
+	case conn := <-ch:
+		return conn.(*WsConn)
+	case <-time.After(wsTestTimeout):
+		t.Fatal("timed out waiting for the connection callback")
+		return nil
+	}
+}
+
+// startWsMux registers the ws routes on a ServeMux served by httptest
+func startWsMux(t *testing.T, config *common.Config) (*Server, *httptest.Server) {
+	config.Network = "ws"
+	config.WsMux = http.NewServeMux()
+	if config.DataHandler == nil {
+		config.DataHandler = echoHandler{}
+	}
+	s := NewServer(config)
+	s.Start()
+	hs := httptest.NewServer(config.WsMux)
+	t.Cleanup(func() {
+		s.Stop()
+		hs.Close()
+	})
+	return s, hs
+}
+
+func wsURL(hs *httptest.Server, path string) string {
+	return "ws" + strings.TrimPrefix(hs.URL, "http") + path
+}
+
+func dialWs(t *testing.T, url string) *websocket.Conn {
+	t.Helper()
+	c, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	c.SetReadDeadline(time.Now().Add(wsTestTimeout))
+	return c
+}
+
+func wsRoundTrip(t *testing.T, c *websocket.Conn, msg string) string {
+	t.Helper()
+	if err := c.WriteMessage(websocket.BinaryMessage, []byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	_, data, err := c.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestWsServerStop(t *testing.T) {
+	cb := newWsTestCallback()
+	port := freePort(t)
+	s := NewServer(&common.Config{
+		Network:      "ws",
+		Ip:           "127.0.0.1",
+		Port:         port,
+		WsUrls:       map[string]string{"/ws": "binary"},
+		DataHandler:  echoHandler{},
+		ConnCallback: cb,
+	})
+	s.Start()
+	url := "ws://127.0.0.1:" + strconv.Itoa(port) + "/ws"
+	c := dialWs(t, url)
+	if got := wsRoundTrip(t, c, "hello"); got != "hello" {
+		t.Fatalf("got %q", got)
+	}
+	waitConn(t, cb.connected)
+
+	s.Stop()
+	waitConn(t, cb.disconnected)
+	if n := len(s.GetAllConn()); n != 0 {
+		t.Fatalf("%d connections left after Stop", n)
+	}
+	if _, _, err := c.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Fatalf("read after Stop: %v", err)
+	}
+	if _, _, err := websocket.DefaultDialer.Dial(url, nil); err == nil {
+		t.Fatal("dial after Stop succeeded")
+	}
+}
+
+func TestWsCheckOrigin(t *testing.T) {
+	// without an allow list only the same origin is accepted
+	_, same := startWsMux(t, &common.Config{WsUrls: map[string]string{"/ws": "binary"}})
+	_, listed := startWsMux(t, &common.Config{
+		WsUrls:           map[string]string{"/ws": "binary"},
+		WsAllowedOrigins: []string{"https://example.com"},
+	})
+	for _, tc := range []struct {
+		hs     *httptest.Server
+		origin string
+		ok     bool
+	}{
+		{same, "", true},
+		{same, same.URL, true},
+		{same, "https://example.com", false},
+		{listed, "", true},
+		{listed, "https://example.com", true},
+		{listed, "https://evil.com", false},
+		{listed, listed.URL, false},
+	} {
+		hs := tc.hs
+		header := http.Header{}
+		if tc.origin != "" {
+			header.Set("Origin", tc.origin)
+		}
+		c, resp, err := websocket.DefaultDialer.Dial(wsURL(hs, "/ws"), header)
+		if tc.ok {
+			if err != nil {
+				t.Fatalf("origin %q: %v", tc.origin, err)
+			}
+			c.Close()
+			continue
+		}
+		if err == nil {
+			c.Close()
+			t.Fatalf("origin %q accepted", tc.origin)
+		}
+		if resp == nil || resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("origin %q: %v", tc.origin, err)
+		}
+	}
+}
+
+// expectClose reads until the server closes the connection and returns the close code
+func expectClose(t *testing.T, c *websocket.Conn) int {
+	t.Helper()
+	for {
+		_, _, err := c.ReadMessage()
+		if err == nil {
+			continue
+		}
+		ce, ok := err.(*websocket.CloseError)
+		if !ok {
+			t.Fatalf("read: %v", err)
+		}
+		return ce.Code
+	}
+}
+
+func TestWsReadLimit(t *testing.T) {
+	cb := newWsTestCallback()
+	_, hs := startWsMux(t, &common.Config{
+		WsUrls:       map[string]string{"/ws": "binary"},
+		WsReadLimit:  100,
+		ConnCallback: cb,
+	})
+	c := dialWs(t, wsURL(hs, "/ws"))
+	msg := strings.Repeat("x", 100)
+	if got := wsRoundTrip(t, c, msg); got != msg {
+		t.Fatalf("got %d bytes", len(got))
+	}
+	if err := c.WriteMessage(websocket.BinaryMessage, []byte(msg+"x")); err != nil {
+		t.Fatal(err)
+	}
+	if code := expectClose(t, c); code != websocket.CloseMessageTooBig {
+		t.Fatalf("close code %d", code)
+	}
+	if code, _ := waitConn(t, cb.disconnected).GetCloseCode(); code != websocket.CloseMessageTooBig {
+		t.Fatalf("GetCloseCode = %d", code)
+	}
+}
+
+type wsUpgradeCallback struct {
+	*wsTestCallback
+	user chan interface{} // the user tag seen in OnConnected
+}
+
+func (cb wsUpgradeCallback) OnConnected(conn common.IConn) {
+	cb.user <- conn.GetTag("user")
+	cb.wsTestCallback.OnConnected(conn)
+}
+
+func (cb wsUpgradeCallback) OnUpgrade(req *http.Request) (bool, int, map[string]interface{}) {
+	switch req.URL.Query().Get("token") {
+	case "ok":
+		return true, 0, map[string]interface{}{"user": "u1"}
+	case "":
+		return false, http.StatusUnauthorized, nil
+	}
+	return false, 0, nil
+}
+
+func TestWsOnUpgrade(t *testing.T) {
+	cb := wsUpgradeCallback{newWsTestCallback(), make(chan interface{}, 1)}
+	_, hs := startWsMux(t, &common.Config{
+		WsUrls:       map[string]string{"/ws": "binary"},
+		ConnCallback: cb,
+	})
+	for _, tc := range []struct {
+		query  string
+		status int
+	}{
+		{"", http.StatusUnauthorized},
+		// a status <= 0 defaults to 403
+		{"?token=bad", http.StatusForbidden},
+	} {
+		c, resp, err := websocket.DefaultDialer.Dial(wsURL(hs, "/ws"+tc.query), nil)
+		if err == nil {
+			c.Close()
+			t.Fatalf("%q: upgrade accepted", tc.query)
+		}
+		if resp == nil || resp.StatusCode != tc.status {
+			t.Fatalf("%q: %v", tc.query, err)
+		}
+	}
+	select {
+	case <-cb.connected:
+		t.Fatal("rejected upgrade created a connection")
+	default:
+	}
+
+	dialWs(t, wsURL(hs, "/ws?token=ok"))
+	waitConn(t, cb.connected)
+	// tags are set before OnConnected
+	if user := <-cb.user; user != "u1" {
+		t.Fatalf("tag user = %v", user)
+	}
+}
+
+type wsFrame struct {
+	fin     bool
+	opcode  int
+	payload []byte
+}
+
+// readFrame reads one unmasked server frame from the raw connection
+func readFrame(r io.Reader) (wsFrame, error) {
+	var h [8]byte
+	if _, err := io.ReadFull(r, h[:2]); err != nil {
+		return wsFrame{}, err
+	}
+	f := wsFrame{fin: h[0]&0x80 != 0, opcode: int(h[0] & 0x0f)}
+	n := uint64(h[1] & 0x7f)
+	switch n {
+	case 126:
+		if _, err := io.ReadFull(r, h[:2]); err != nil {
+			return f, err
+		}
+		n = uint64(binary.BigEndian.Uint16(h[:2]))
+	case 127:
+		if _, err := io.ReadFull(r, h[:]); err != nil {
+			return f, err
+		}
+		n = binary.BigEndian.Uint64(h[:])
+	}
+	f.payload = make([]byte, n)
+	_, err := io.ReadFull(r, f.payload)
+	return f, err
+}
+
+// closeFrames reads raw frames until the server drops the connection
+func closeFrames(t *testing.T, c *websocket.Conn) []wsFrame {
+	t.Helper()
+	raw := c.UnderlyingConn()
+	raw.SetReadDeadline(time.Now().Add(wsTestTimeout))
+	var frames []wsFrame
+	for {
+		f, err := readFrame(raw)
+		if err == io.EOF {
+			return frames
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.opcode == websocket.CloseMessage {
+			frames = append(frames, f)
+		}
+	}
+}
+
+func checkCloseFrame(t *testing.T, f wsFrame, code int, reason string) {
+	t.Helper()
+	if len(f.payload) < 2 || int(binary.BigEndian.Uint16(f.payload)) != code || string(f.payload[2:]) != reason {
+		t.Fatalf("close frame %x, want %d %q", f.payload, code, reason)
+	}
+}
+
+func TestWsCloseWithCode(t *testing.T) {
+	cb := newWsTestCallback()
+	_, hs := startWsMux(t, &common.Config{
+		WsUrls:       map[string]string{"/ws": "binary"},
+		ConnCallback: cb,
+	})
+	c := dialWs(t, wsURL(hs, "/ws"))
+	ws := waitConn(t, cb.connected)
+	ws.CloseWithCode(4001, "bye")
+	// a second call must not send another close frame
+	ws.CloseWithCode(4002, "again")
+
+	f, err := readFrame(c.UnderlyingConn())
+	if err != nil || f.opcode != websocket.CloseMessage {
+		t.Fatalf("frame %d: %v", f.opcode, err)
+	}
+	checkCloseFrame(t, f, 4001, "bye")
+	if err := c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(4003, "ack"), time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if frames := closeFrames(t, c); len(frames) != 0 {
+		t.Fatalf("%d more close frames", len(frames))
+	}
+	if code, text := waitConn(t, cb.disconnected).GetCloseCode(); code != 4003 || text != "ack" {
+		t.Fatalf("GetCloseCode = %d %q", code, text)
+	}
+}
+
+// a close from the peer is echoed once and its code is reported
+func TestWsPeerClose(t *testing.T) {
+	cb := newWsTestCallback()
+	_, hs := startWsMux(t, &common.Config{
+		WsUrls:       map[string]string{"/ws": "binary"},
+		ConnCallback: cb,
+	})
+	c := dialWs(t, wsURL(hs, "/ws"))
+	waitConn(t, cb.connected)
+	if err := c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(4004, "client"), time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	frames := closeFrames(t, c)
+	if len(frames) != 1 {
+		t.Fatalf("%d close frames", len(frames))
+	}
+	checkCloseFrame(t, frames[0], 4004, "")
+	if code, text := waitConn(t, cb.disconnected).GetCloseCode(); code != 4004 || text != "client" {
+		t.Fatalf("GetCloseCode = %d %q", code, text)
+	}
+}
+
+type prefixHandler string
+
+func (p prefixHandler) Handle(data []byte, conn common.IConn) ([]byte, error) {
+	conn.Send(append([]byte(p), data...))
+	return nil, nil
+}
+
+func TestWsRoutes(t *testing.T) {
+	s, hs := startWsMux(t, &common.Config{
+		WsRoutes: []common.WsRoute{{Path: "/a", MsgType: "binary"}},
+	})
+	c1 := dialWs(t, wsURL(hs, "/a"))
+	if got := wsRoundTrip(t, c1, "x"); got != "x" {
+		t.Fatalf("got %q", got)
+	}
+
+	// replacing a route applies to new connections only
+	if err := s.AddWsRoute(common.WsRoute{Path: "/a", DataHandler: prefixHandler("v2:")}); err != nil {
+		t.Fatal(err)
+	}
+	c2 := dialWs(t, wsURL(hs, "/a"))
+	if got := wsRoundTrip(t, c2, "x"); got != "v2:x" {
+		t.Fatalf("replaced route: got %q", got)
+	}
+	if got := wsRoundTrip(t, c1, "y"); got != "y" {
+		t.Fatalf("existing connection: got %q", got)
+	}
+
+	// a path added at runtime is served
+	if err := s.AddWsRoute(common.WsRoute{Path: "/b", DataHandler: prefixHandler("b:")}); err != nil {
+		t.Fatal(err)
+	}
+	if got := wsRoundTrip(t, dialWs(t, wsURL(hs, "/b")), "x"); got != "b:x" {
+		t.Fatalf("added route: got %q", got)
+	}
+
+	if !s.RemoveWsRoute("/a") {
+		t.Fatal("RemoveWsRoute = false")
+	}
+	if s.RemoveWsRoute("/a") {
+		t.Fatal("second RemoveWsRoute = true")
+	}
+	c, resp, err := websocket.DefaultDialer.Dial(wsURL(hs, "/a"), nil)
+	if err == nil {
+		c.Close()
+		t.Fatal("removed route accepted")
+	}
+	if resp == nil || resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("removed route: %v", err)
+	}
+	if got := wsRoundTrip(t, c2, "z"); got != "v2:z" {
+		t.Fatalf("connection after remove: got %q", got)
+	}
+
+	// the path can be added again
+	if err := s.AddWsRoute(common.WsRoute{Path: "/a"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := wsRoundTrip(t, dialWs(t, wsURL(hs, "/a")), "x"); got != "x" {
+		t.Fatalf("re-added route: got %q", got)
+	}
+}
+
+type closeReader struct {
+	io.Reader
+	closed chan struct{}
+}
+
+func (r closeReader) Close() error {
+	close(r.closed)
+	return nil
+}
+
+// streamTrigger answers every message with a streamed message
+type streamTrigger struct {
+	r io.Reader
+}
+
+func (h streamTrigger) Handle(data []byte, conn common.IConn) ([]byte, error) {
+	conn.(*WsConn).SendStream(h.r)
+	return nil, nil
+}
+
+func TestWsSendStream(t *testing.T) {
+	data := make([]byte, 100<<10)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	r := closeReader{bytes.NewReader(data), make(chan struct{})}
+	_, hs := startWsMux(t, &common.Config{
+		WsUrls:      map[string]string{"/ws": "binary"},
+		DataHandler: streamTrigger{r},
+	})
+	c := dialWs(t, wsURL(hs, "/ws"))
+	if err := c.WriteMessage(websocket.BinaryMessage, []byte("go")); err != nil {
+		t.Fatal(err)
+	}
+
+	raw := c.UnderlyingConn()
+	raw.SetReadDeadline(time.Now().Add(wsTestTimeout))
+	var got []byte
+	frames := 0
+	for {
+		f, err := readFrame(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := websocket.BinaryMessage
+		if frames > 0 {
+			want = 0 // continuation
+		}
+		if f.opcode != want {
+			t.Fatalf("frame %d: opcode %d", frames, f.opcode)
+		}
+		frames++
+		got = append(got, f.payload...)
+		if f.fin {
+			break
+		}
+	}
+	if frames < 2 {
+		t.Fatalf("streamed in %d frames", frames)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("got %d bytes, want %d", len(got), len(data))
+	}
+	select {
+	case <-r.closed:
+	case <-time.After(wsTestTimeout):
+		t.Fatal("reader not closed")
+	}
+}
+
+// streamEcho reads the message through HandleStream, or only its first bytes
+type streamEcho struct {
+	readAll bool
+}
+
+func (h streamEcho) Handle(data []byte, conn common.IConn) ([]byte, error) {
+	return nil, nil
+}
+
+func (h streamEcho) HandleStream(msgType int, r io.Reader, conn common.IConn) error {
+	if !h.readAll {
+		_, err := io.ReadFull(r, make([]byte, 10))
+		return err
+	}
+	data, err := io.ReadAll(r)
+	if err == nil {
+		conn.Send(data)
+	}
+	return err
+}
+
+// writeFrames sends one message split into several frames
+func writeFrames(t *testing.T, c *websocket.Conn, data []byte) {
+	t.Helper()
+	w, err := c.NextWriter(websocket.BinaryMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for len(data) > 0 {
+		n := 1000
+		if n > len(data) {
+			n = len(data)
+		}
+		// a full write buffer is flushed as a frame
+		if _, err := w.Write(data[:n]); err != nil {
+			t.Fatal(err)
+		}
+		data = data[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWsReadLimitStream(t *testing.T) {
+	const limit = 5000
+	for _, tc := range []struct {
+		name     string
+		readAll  bool
+		compress bool
+	}{
+		// each frame is within the limit, the message is not
+		{"frames", true, false},
+		// the rest of an oversized message is discarded by the next read
+		{"partial read", false, false},
+		// compressed frames are far smaller than the message
+		{"compressed", true, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cb := newWsTestCallback()
+			_, hs := startWsMux(t, &common.Config{
+				WsUrls:              map[string]string{"/ws": "binary"},
+				WsReadLimit:         limit,
+				WsEnableCompression: true,
+				DataHandler:         streamEcho{tc.readAll},
+				ConnCallback:        cb,
+			})
+			d := websocket.Dialer{EnableCompression: tc.compress}
+			c, _, err := d.Dial(wsURL(hs, "/ws"), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			c.SetReadDeadline(time.Now().Add(wsTestTimeout))
+			if tc.readAll {
+				msg := bytes.Repeat([]byte("x"), limit)
+				if got := wsRoundTrip(t, c, string(msg)); got != string(msg) {
+					t.Fatalf("got %d bytes", len(got))
+				}
+			}
+
+			writeFrames(t, c, bytes.Repeat([]byte("x"), 2*limit))
+			if code := expectClose(t, c); code != websocket.CloseMessageTooBig {
+				t.Fatalf("close code %d", code)
+			}
+			if code, _ := waitConn(t, cb.disconnected).GetCloseCode(); code != websocket.CloseMessageTooBig {
+				t.Fatalf("GetCloseCode = %d", code)
+			}
+		})
+	}
+}
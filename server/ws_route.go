@@ -0,0 +1,173 @@
+package server
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/golang/glog"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"xconn/common"
+)
+
+/**
+ * @brief: ws路由，创建后不再修改，替换路由时生成新对象，已有连接继续使用原路由
+ */
+type wsRoute struct {
+	path     string
+	msgType  string              // text或者binary
+	config   *common.Config      // 路由生效的配置，Config的拷贝，ConnCallback仍为服务端
+	callback common.ConnCallback // 应用回调
+	upgrader websocket.Upgrader
+}
+
+/**
+ * @brief: 创建路由，零值字段使用Config中对应的配置
+ */
+func (ts *Server)newWsRoute(route common.WsRoute)*wsRoute{
+	config := *ts.config
+	if route.DataHandler != nil {
+		config.DataHandler = route.DataHandler
+	}
+	if route.Label != "" {
+		config.Label = route.Label
+	}
+	if route.AllowedOrigins != nil {
+		config.WsAllowedOrigins = route.AllowedOrigins
+	}
+	if route.Subprotocols != nil {
+		config.WsSubprotocols = route.Subprotocols
+	}
+	if route.EnableCompression {
+		config.WsEnableCompression = true
+	}
+	if route.CompressionLevel != 0 {
+		config.WsCompressionLevel = route.CompressionLevel
+	}
+	if route.ReadBufferSize > 0 {
+		config.WsReadBufferSize = route.ReadBufferSize
+	}
+	if route.WriteBufferSize > 0 {
+		config.WsWriteBufferSize = route.WriteBufferSize
+	}
+	if route.WriteBufferPool {
+		config.WsWriteBufferPool = true
+	}
+	if route.HandshakeTimeout > 0 {
+		config.WsHandshakeTimeout = route.HandshakeTimeout
+	}
+	if route.ReadLimit > 0 {
+		config.WsReadLimit = route.ReadLimit
+	}
+
+	r := &wsRoute{
+		path:     route.Path,
+		msgType:  route.MsgType,
+		config:   &config,
+		callback: route.ConnCallback,
+		upgrader: newWsUpgrader(&config),
+	}
+	if r.callback == nil {
+		r.callback = ts.connCallback
+	}
+	return r
+}
+
+/**
+ * @brief: 增加ws路由，路径已存在时替换，已有连接不受影响
+ * WsGin不支持在服务中注册新路径，新路径需要在engine开始服务前增加；WsMux和独立http服务可以随时增加
+ * @param1 route: 路由
+ */
+func (ts *Server)AddWsRoute(route common.WsRoute)error{
+	if ts.config.Network != "ws" {
+		return errors.New("not a ws server")
+	}
+	if route.Path == "" {
+		return errors.New("empty ws path")
+	}
+
+	ts.wsRoutes.Store(route.Path, ts.newWsRoute(route))
+
+	ts.wsMu.Lock()
+	defer ts.wsMu.Unlock()
+	if ts.wsPaths[route.Path] {
+		// 路由器不支持重复注册，处理函数按路径查找路由表
+		return nil
+	}
+	ts.wsPaths[route.Path] = true
+	handler := ts.wsHandler(route.Path)
+	if ts.config.WsGin != nil {
+		ts.config.WsGin.GET(route.Path, func(ctx *gin.Context) {
+			handler(ctx.Writer, ctx.Request)
+		})
+	} else {
+		ts.wsMux.HandleFunc(route.Path, handler)
+	}
+	glog.Infoln(ts.config.Label, "增加ws路由:", route.Path)
+	return nil
+}
+
+/**
+ * @brief: 删除ws路由，之后该路径的请求回复404，已有连接不受影响，需要时通过GetAllConn、WsConn.GetPath查找后关闭
+ * @param1 path: 路径
+ * @return1: 路径是否存在
+ */
+func (ts *Server)RemoveWsRoute(path string)bool{
+	_, ok := ts.wsRoutes.Load(path)
+	ts.wsRoutes.Delete(path)
+	if ok {
+		glog.Infoln(ts.config.Label, "删除ws路由:", path)
+	}
+	return ok
+}
+
+/**
+ * @brief: ws路径处理函数，按路由升级为websocket连接
+ * @param1 path: 路径
+ */
+func (ts *Server)wsHandler(path string)http.HandlerFunc{
+	return func(w http.ResponseWriter, r *http.Request) {
+		value, ok := ts.wsRoutes.Load(path)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		route := value.(*wsRoute)
+
+		var tags map[string]interface{}
+		if h, ok := route.callback.(common.UpgradeHandler); ok {
+			accept, status, t := h.OnUpgrade(r)
+			if !accept {
+				if status <= 0 {
+					status = http.StatusForbidden
+				}
+				glog.Infoln(route.config.Label, "拒绝ws连接:", r.RemoteAddr, path, status)
+				http.Error(w, http.StatusText(status), status)
+				return
+			}
+			tags = t
+		}
+
+		conn, err := route.upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// Upgrade已经回复了错误
+			glog.Error(err)
+			return
+		}
+
+		wsconn := newWsConn(conn, r, route, ts.workers)
+		for key, tag := range tags {
+			wsconn.SetTag(key, tag)
+		}
+		wsconn.Start()
+	}
+}
+
+/**
+ * @brief: 连接对应的应用回调，ws连接使用所属路由的回调
+ */
+func (ts *Server)callback(conn common.IConn)common.ConnCallback{
+	if ws, ok := conn.(*WsConn); ok && ws.route != nil {
+		return ws.route.callback
+	}
+	return ts.connCallback
+}
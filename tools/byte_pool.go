@@ -0,0 +1,66 @@
+package tools
+
+import (
+	"math/bits"
+	"sync"
+)
+
+const (
+	minPoolShift = 9  // 最小分级 512B
+	maxPoolShift = 20 // 最大分级 1MB
+)
+
+// 按2的幂分级的字节池，下标i对应容量 1 << (minPoolShift + i)
+var bytePools [maxPoolShift - minPoolShift + 1]sync.Pool
+
+/**
+ * @brief: 从字节池获取缓冲区
+ * @param1 size: 需要的长度
+ * @return1: 长度为size的切片，容量为对应分级大小；超过最大分级时直接分配，不进入池
+ */
+func GetBytes(size int)[]byte{
+	if size <= 0 {
+		return nil
+	}
+	idx := poolIndex(size)
+	if idx < 0 {
+		return make([]byte, size)
+	}
+	if v := bytePools[idx].Get(); v != nil {
+		b := v.(*[]byte)
+		return (*b)[:size]
+	}
+	return make([]byte, size, 1 << uint(minPoolShift + idx))
+}
+
+/**
+ * @brief: 归还缓冲区到字节池，归还后调用方不得再使用该切片
+ * @param1 b: 由GetBytes获取的缓冲区
+ */
+func PutBytes(b []byte){
+	c := cap(b)
+	if c == 0 {
+		return
+	}
+	idx := poolIndex(c)
+	if idx < 0 || 1 << uint(minPoolShift + idx) != c {
+		// 非池分配的缓冲区，直接丢弃
+		return
+	}
+	b = b[:c]
+	bytePools[idx].Put(&b)
+}
+
+/**
+ * @brief: 计算size对应的分级下标，超出最大分级返回-1
+ */
+func poolIndex(size int)int{
+	shift := minPoolShift
+	if size > 1 << minPoolShift {
+		shift = bits.Len(uint(size - 1))
+	}
+	if shift > maxPoolShift {
+		return -1
+	}
+	return shift - minPoolShift
+}
@@ -0,0 +1,8 @@
+package tools
+
+import "time"
+
+// cpuTime is not measured on windows, the benchmarks only report goroutines there
+func cpuTime() time.Duration {
+	return 0
+}
@@ -3,6 +3,8 @@ package tools
 import (
 	"context"
 	"github.com/golang/glog"
+	"hash/fnv"
+	"sync/atomic"
 )
 
 /**
@@ -12,7 +14,7 @@ type DataTransport struct {
 	dataChans []chan interface{}
 	ctx       context.Context
 	cancel    context.CancelFunc
-	index     int
+	index     uint32 // 轮询分配计数，原子操作
 }
 
 /**
@@ -33,7 +35,6 @@ func NewDataTransport(cc, cap int)*DataTransport{
 		dt.dataChans[i] = make(chan interface{}, cap)
 	}
 
-	dt.index = 0
 	ctx, cancel := context.WithCancel(context.Background())
 	dt.ctx = ctx
 	dt.cancel = cancel
@@ -75,13 +76,69 @@ func (dt *DataTransport)Produce(data interface{}){
 		dt.dataChans[0] <- data
 	}else{
 		// 按顺序分配给各个处理队列
-		dt.dataChans[dt.index % len(dt.dataChans)] <- data
-		if dt.index > 65535{
-			dt.index = 0
-		}else{
-			dt.index++
+		i := atomic.AddUint32(&dt.index, 1) - 1
+		dt.dataChans[i % uint32(len(dt.dataChans))] <- data
+	}
+}
+
+/**
+ * @brief: 按key生产数据，相同key的数据总是分配到同一个消费队列，保证按生产顺序消费
+ * @param1 key: 分区key，例如设备id、ssrc
+ * @param2 data: 数据，如果是指针类型，建议使用深拷贝模式创建新对象传入
+ */
+func (dt *DataTransport)ProduceKey(key string, data interface{}){
+	if data == nil{
+		return
+	}
+
+	defer func() {
+		if x := recover(); x != nil {
+			glog.Errorln("DataTransport.ProduceKey recover:", x)
 		}
+	}()
+
+	dt.dataChans[dt.partition(key)] <- data
+}
+
+/**
+ * @brief: 计算key对应的消费队列下标
+ */
+func (dt *DataTransport)partition(key string)int{
+	if len(dt.dataChans) == 1{
+		return 0
 	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(dt.dataChans)))
+}
+
+/**
+ * @brief: 各消费队列当前积压的数据数量
+ */
+func (dt *DataTransport)Depths()[]int{
+	depths := make([]int, len(dt.dataChans))
+	for i := range dt.dataChans{
+		depths[i] = len(dt.dataChans[i])
+	}
+	return depths
+}
+
+/**
+ * @brief: 所有消费队列当前积压的数据总数
+ */
+func (dt *DataTransport)Depth()int{
+	n := 0
+	for i := range dt.dataChans{
+		n += len(dt.dataChans[i])
+	}
+	return n
+}
+
+/**
+ * @brief: 单个消费队列的容量
+ */
+func (dt *DataTransport)Cap()int{
+	return cap(dt.dataChans[0])
 }
 
 /**
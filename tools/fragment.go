@@ -0,0 +1,333 @@
+package tools
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+const (
+	FragmentHeaderSize = 12 // 分片头长度：magic(4) id(4) index(2) count(2)
+)
+
+// 分片头标识，不是合法的utf-8开头，也不是rtp、stun等常见协议的开头
+var fragmentMagic = [4]byte{0xff, 0xfe, 'X', 'F'}
+
+/**
+ * @brief: 数据报分片，超过长度的数据拆分为带编号的分片，未超过的也加上分片头作为只有一个分片的分片组发送
+ * 每个数据报都带分片头，接收端不会把恰好以magic开头的原始数据误认为分片
+ * 分片格式：magic(4) id(4) index(2) count(2) data，大端序；不是线程安全的
+ */
+type Fragmenter struct {
+	size   int    // 分片最大长度，包含分片头
+	nextId uint32 // 下一个分片组id
+}
+
+/**
+ * @brief: 创建分片
+ * @param1 size: 分片最大长度，包含分片头，一般为路径MTU减去ip、udp头
+ */
+func NewFragmenter(size int)*Fragmenter{
+	if size <= FragmentHeaderSize {
+		size = 1400
+	}
+	return &Fragmenter{size: size, nextId: rand.Uint32()}
+}
+
+/**
+ * @brief: 拆分数据
+ * @return1: 数据报列表，未超过长度时为一个分片，超过0xffff个分片时返回nil
+ */
+func (f *Fragmenter)Split(data []byte)[][]byte{
+	mss := f.size - FragmentHeaderSize
+	count := (len(data) + mss - 1) / mss
+	if count == 0 {
+		// 空数据也要有分片头
+		count = 1
+	}
+	if count > 0xffff {
+		return nil
+	}
+
+	id := f.nextId
+	f.nextId++
+	frags := make([][]byte, count)
+	for i := 0; i < count; i++ {
+		chunk := data[i * mss:]
+		if len(chunk) > mss {
+			chunk = chunk[:mss]
+		}
+		frag := make([]byte, FragmentHeaderSize + len(chunk))
+		copy(frag, fragmentMagic[:])
+		binary.BigEndian.PutUint32(frag[4:], id)
+		binary.BigEndian.PutUint16(frag[8:], uint16(i))
+		binary.BigEndian.PutUint16(frag[10:], uint16(count))
+		copy(frag[FragmentHeaderSize:], chunk)
+		frags[i] = frag
+	}
+	return frags
+}
+
+/**
+ * @brief: 是否为分片，包括只有一个分片的数据报；开启分片时不是分片的数据报应当丢弃
+ */
+func IsFragment(pkt []byte)bool{
+	if len(pkt) < FragmentHeaderSize {
+		return false
+	}
+	if pkt[0] != fragmentMagic[0] || pkt[1] != fragmentMagic[1] || pkt[2] != fragmentMagic[2] || pkt[3] != fragmentMagic[3] {
+		return false
+	}
+	count := binary.BigEndian.Uint16(pkt[10:])
+	return count > 0 && binary.BigEndian.Uint16(pkt[8:]) < count
+}
+
+/**
+ * @brief: 多个分片重组共用的内存上限，线程安全
+ * 每个会话的Reassembler只能淘汰自己的分片组，共用上限用完时新分片组直接丢弃，直到其他会话的分片组收齐、超时或会话关闭
+ */
+type ReassemblyBudget struct {
+	max  int64
+	used int64
+}
+
+/**
+ * @brief: 创建共用内存上限
+ * @param1 maxBytes: 所有重组中的分片最大占用内存，<=0时默认64MB
+ */
+func NewReassemblyBudget(maxBytes int)*ReassemblyBudget{
+	if maxBytes <= 0 {
+		maxBytes = 64 << 20
+	}
+	return &ReassemblyBudget{max: int64(maxBytes)}
+}
+
+func (b *ReassemblyBudget)acquire(n int)bool{
+	for {
+		used := atomic.LoadInt64(&b.used)
+		if used + int64(n) > b.max {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&b.used, used, used + int64(n)) {
+			return true
+		}
+	}
+}
+
+func (b *ReassemblyBudget)release(n int){
+	atomic.AddInt64(&b.used, -int64(n))
+}
+
+/**
+ * @brief: 正在重组的分片组
+ */
+type fragmentGroup struct {
+	id       uint32
+	frags    [][]byte  // 按下标存放的分片数据
+	received int       // 已收到的分片数
+	size     int       // 非最后分片的数据长度，0表示还未收到非最后分片
+	bytes    int       // 占用内存，包含分片数据和分片列表本身
+	deadline time.Time // 超时时间
+}
+
+// 分片组固定占用的内存，按分片数分配的列表另外计算
+var (
+	fragmentGroupOverhead = int(unsafe.Sizeof(fragmentGroup{})) + 64
+	fragmentSliceSize     = int(unsafe.Sizeof([]byte(nil)))
+)
+
+/**
+ * @brief: 分片重组，超时未收齐或占用内存超过上限时丢弃最早的分片组
+ * 占用内存包含分片数据和按分片数分配的列表，只有分片头的空分片、分片数或分片长度不一致的分片直接丢弃
+ */
+type Reassembler struct {
+	mu       sync.Mutex
+	timeout  time.Duration
+	maxBytes int
+	budget   *ReassemblyBudget         // 共用内存上限，可以为nil
+	closed   bool                      // 已关闭，不再接受分片组
+	bytes    int                       // 当前占用内存
+	groups   map[uint32]*fragmentGroup // 正在重组的分片组
+	order    []*fragmentGroup          // 按创建顺序排列，用于超时、超限淘汰
+}
+
+/**
+ * @brief: 创建分片重组
+ * @param1 timeout: 重组超时，<=0时默认5秒
+ * @param2 maxBytes: 重组中的分片最大占用内存，<=0时默认4MB
+ * @param3 budget: 与其他Reassembler共用的内存上限，为nil时只受maxBytes限制
+ */
+func NewReassembler(timeout time.Duration, maxBytes int, budget *ReassemblyBudget)*Reassembler{
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	if maxBytes <= 0 {
+		maxBytes = 4 << 20
+	}
+	return &Reassembler{
+		timeout:  timeout,
+		maxBytes: maxBytes,
+		budget:   budget,
+		groups:   make(map[uint32]*fragmentGroup),
+	}
+}
+
+/**
+ * @brief: 加入分片
+ * @param1 pkt: 分片，需要先用IsFragment判断，返回后不再引用
+ * @return1: 收齐后的完整数据，只有一个分片时引用pkt
+ * @return2: 是否已收齐
+ */
+func (r *Reassembler)Add(pkt []byte)([]byte, bool){
+	id := binary.BigEndian.Uint32(pkt[4:])
+	index := int(binary.BigEndian.Uint16(pkt[8:]))
+	count := int(binary.BigEndian.Uint16(pkt[10:]))
+	data := pkt[FragmentHeaderSize:]
+	if count == 1 {
+		// 未拆分的数据
+		return data, true
+	}
+	last := index == count - 1
+	if len(data) == 0 {
+		// 每个分片至少1字节数据
+		return nil, false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return nil, false
+	}
+
+	now := time.Now()
+	r.expire(now)
+
+	g, ok := r.groups[id]
+	if !ok {
+		overhead := fragmentGroupOverhead + count * fragmentSliceSize
+		if count > r.maxBytes || overhead + len(data) > r.maxBytes || !r.reserve(overhead, nil) {
+			// 分片数超过上限能容纳的数量
+			return nil, false
+		}
+		g = &fragmentGroup{id: id, frags: make([][]byte, count), bytes: overhead, deadline: now.Add(r.timeout)}
+		r.groups[id] = g
+		r.order = append(r.order, g)
+	}
+	if len(g.frags) != count || g.frags[index] != nil {
+		// 分片数不一致或重复
+		return nil, false
+	}
+
+	// 除最后一个分片外长度相同，最后一个分片不超过该长度
+	size := g.size
+	if !last {
+		if size == 0 {
+			size = len(data)
+		} else if len(data) != size {
+			r.remove(g)
+			return nil, false
+		}
+	}
+	if size > 0 {
+		if last && len(data) > size || (count - 1) * size > r.maxBytes {
+			r.remove(g)
+			return nil, false
+		}
+		if g.size == 0 {
+			if f := g.frags[count - 1]; f != nil && len(f) > size {
+				r.remove(g)
+				return nil, false
+			}
+			g.size = size
+		}
+	}
+
+	if !r.reserve(len(data), g) {
+		r.remove(g)
+		return nil, false
+	}
+
+	frag := make([]byte, len(data))
+	copy(frag, data)
+	g.frags[index] = frag
+	g.received++
+	g.bytes += len(frag)
+	if g.received < count {
+		return nil, false
+	}
+
+	msg := make([]byte, 0, (count - 1) * g.size + len(g.frags[count - 1]))
+	for _, f := range g.frags {
+		msg = append(msg, f...)
+	}
+	r.remove(g)
+	return msg, true
+}
+
+/**
+ * @brief: 关闭，丢弃所有分片组并归还共用内存，之后加入的分片直接丢弃
+ */
+func (r *Reassembler)Close(){
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.closed = true
+	for len(r.order) > 0 {
+		r.remove(r.order[0])
+	}
+}
+
+/**
+ * @brief: 淘汰最早的分片组直到能再占用n字节，成功时计入占用内存
+ * @param2 keep: 不淘汰的分片组
+ * @return1: 是否能占用
+ */
+func (r *Reassembler)reserve(n int, keep *fragmentGroup)bool{
+	for {
+		if r.bytes + n <= r.maxBytes && (r.budget == nil || r.budget.acquire(n)) {
+			r.bytes += n
+			return true
+		}
+		victim := -1
+		for i, g := range r.order {
+			if g != keep {
+				victim = i
+				break
+			}
+		}
+		if victim < 0 {
+			return false
+		}
+		r.remove(r.order[victim])
+	}
+}
+
+/**
+ * @brief: 丢弃超时的分片组
+ */
+func (r *Reassembler)expire(now time.Time){
+	for len(r.order) > 0 && now.After(r.order[0].deadline) {
+		r.remove(r.order[0])
+	}
+}
+
+func (r *Reassembler)remove(g *fragmentGroup){
+	if r.groups[g.id] != g {
+		return
+	}
+	delete(r.groups, g.id)
+	r.bytes -= g.bytes
+	if r.budget != nil {
+		r.budget.release(g.bytes)
+	}
+	for i := range r.order {
+		if r.order[i] == g {
+			r.order = append(r.order[:i], r.order[i + 1:]...)
+			break
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package tools
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func fragmentPacket(id uint32, index, count int, data []byte) []byte {
+	pkt := make([]byte, FragmentHeaderSize+len(data))
+	copy(pkt, fragmentMagic[:])
+	binary.BigEndian.PutUint32(pkt[4:], id)
+	binary.BigEndian.PutUint16(pkt[8:], uint16(index))
+	binary.BigEndian.PutUint16(pkt[10:], uint16(count))
+	copy(pkt[FragmentHeaderSize:], data)
+	return pkt
+}
+
+func TestFragmentRoundTrip(t *testing.T) {
+	f := NewFragmenter(100)
+	r := NewReassembler(time.Second, 0, nil)
+	rnd := rand.New(rand.NewSource(1))
+	for _, size := range []int{0, 1, 88, 89, 100, 88 * 3, 88*3 + 1, 10000} {
+		data := make([]byte, size)
+		rnd.Read(data)
+		frags := f.Split(data)
+		if size <= 88 && len(frags) != 1 || size > 88 && len(frags) < 2 {
+			t.Fatalf("size %d: split into %d fragments", size, len(frags))
+		}
+		rnd.Shuffle(len(frags), func(i, j int) { frags[i], frags[j] = frags[j], frags[i] })
+		for i, frag := range frags {
+			if !IsFragment(frag) || len(frag) > 100 {
+				t.Fatalf("size %d: bad fragment %d", size, i)
+			}
+			msg, ok := r.Add(frag)
+			if ok != (i == len(frags)-1) {
+				t.Fatalf("size %d: fragment %d complete = %v", size, i, ok)
+			}
+			if ok && !bytes.Equal(msg, data) {
+				t.Fatalf("size %d: reassembled data differs", size)
+			}
+		}
+		if r.bytes != 0 || len(r.groups) != 0 {
+			t.Fatalf("size %d: %d bytes, %d groups left", size, r.bytes, len(r.groups))
+		}
+	}
+}
+
+func TestReassemblerDuplicate(t *testing.T) {
+	r := NewReassembler(time.Second, 0, nil)
+	frags := NewFragmenter(20).Split([]byte("0123456789abcdefghijklmn"))
+	if len(frags) != 3 {
+		t.Fatalf("%d fragments", len(frags))
+	}
+	r.Add(frags[0])
+	before := r.bytes
+	if _, ok := r.Add(frags[0]); ok || r.bytes != before {
+		t.Fatalf("duplicate fragment accepted, %d bytes before, %d after", before, r.bytes)
+	}
+	r.Add(frags[1])
+	r.Add(frags[1])
+	msg, ok := r.Add(frags[2])
+	if !ok || string(msg) != "0123456789abcdefghijklmn" {
+		t.Fatalf("Add = %q, %v", msg, ok)
+	}
+	// a late duplicate starts a new group which never completes
+	if _, ok := r.Add(frags[0]); ok {
+		t.Fatal("late duplicate completed")
+	}
+}
+
+func TestReassemblerTimeout(t *testing.T) {
+	r := NewReassembler(20*time.Millisecond, 0, nil)
+	frags := NewFragmenter(20).Split(make([]byte, 30))
+	r.Add(frags[0])
+	time.Sleep(40 * time.Millisecond)
+	// adding the rest expires the group first, so it starts over
+	if _, ok := r.Add(frags[1]); ok {
+		t.Fatal("completed with an expired fragment")
+	}
+	if len(r.order) != 1 || r.order[0].received != 1 {
+		t.Fatal("expired group not removed")
+	}
+	time.Sleep(40 * time.Millisecond)
+	r.Add(fragmentPacket(1, 0, 2, []byte{1}))
+	if len(r.groups) != 1 {
+		t.Fatalf("%d groups after expiry", len(r.groups))
+	}
+}
+
+func TestReassemblerEmptyPayload(t *testing.T) {
+	r := NewReassembler(time.Second, 0, nil)
+	for i := uint32(0); i < 1000; i++ {
+		pkt := fragmentPacket(i, 0, 0xffff, nil)
+		if !IsFragment(pkt) {
+			t.Fatal("not a fragment")
+		}
+		r.Add(pkt)
+	}
+	if r.bytes != 0 || len(r.groups) != 0 {
+		t.Fatalf("header-only fragments kept %d bytes in %d groups", r.bytes, len(r.groups))
+	}
+}
+
+// header-sized fragments with a large count each allocate a fragment list,
+// which counts against the cap
+func TestReassemblerCap(t *testing.T) {
+	const maxBytes = 64 << 10
+	r := NewReassembler(time.Minute, maxBytes, nil)
+	for i := uint32(0); i < 10000; i++ {
+		r.Add(fragmentPacket(i, 0, 1000, []byte{1}))
+		if r.bytes > maxBytes {
+			t.Fatalf("group %d: %d bytes over the cap", i, r.bytes)
+		}
+	}
+	if len(r.groups) == 0 || len(r.groups) > maxBytes/(1000*fragmentSliceSize) {
+		t.Fatalf("%d groups kept", len(r.groups))
+	}
+	// the newest groups survive
+	if _, ok := r.groups[9999]; !ok {
+		t.Fatal("newest group evicted")
+	}
+
+	// a count whose fragment list alone exceeds the cap is rejected
+	r.Add(fragmentPacket(20000, 0, maxBytes/fragmentSliceSize+1, []byte{1}))
+	if _, ok := r.groups[20000]; ok {
+		t.Fatal("group larger than the cap accepted")
+	}
+	// as is a count whose fragments cannot fit at the size already seen
+	r.Add(fragmentPacket(20001, 0, 100, make([]byte, 1000)))
+	if _, ok := r.groups[20001]; ok {
+		t.Fatal("message larger than the cap accepted")
+	}
+	if r.bytes > maxBytes {
+		t.Fatalf("%d bytes over the cap", r.bytes)
+	}
+}
+
+func TestReassemblerInconsistent(t *testing.T) {
+	r := NewReassembler(time.Second, 0, nil)
+	r.Add(fragmentPacket(1, 0, 3, make([]byte, 10)))
+	// count differs
+	r.Add(fragmentPacket(1, 1, 4, make([]byte, 10)))
+	if r.groups[1].received != 1 {
+		t.Fatal("fragment with another count accepted")
+	}
+	// a middle fragment of another size drops the group
+	r.Add(fragmentPacket(1, 1, 3, make([]byte, 9)))
+	if _, ok := r.groups[1]; ok || r.bytes != 0 {
+		t.Fatal("inconsistent group kept")
+	}
+	// a last fragment longer than the others
+	r.Add(fragmentPacket(2, 2, 3, make([]byte, 20)))
+	r.Add(fragmentPacket(2, 0, 3, make([]byte, 10)))
+	if _, ok := r.groups[2]; ok || r.bytes != 0 {
+		t.Fatal("inconsistent group kept")
+	}
+}
+
+// a datagram that happens to start with the magic is still delivered intact,
+// since every datagram carries a header when fragmentation is enabled
+func TestFragmentMagicPayload(t *testing.T) {
+	r := NewReassembler(time.Second, 0, nil)
+	data := fragmentPacket(7, 0, 3, []byte("payload"))
+	frags := NewFragmenter(100).Split(data)
+	if len(frags) != 1 || !IsFragment(frags[0]) {
+		t.Fatalf("split into %d fragments", len(frags))
+	}
+	msg, ok := r.Add(frags[0])
+	if !ok || !bytes.Equal(msg, data) {
+		t.Fatalf("Add = %x, %v", msg, ok)
+	}
+	if len(r.groups) != 0 {
+		t.Fatal("single fragment started a group")
+	}
+}
+
+func TestReassemblyBudget(t *testing.T) {
+	const maxBytes = 64 << 10
+	budget := NewReassemblyBudget(maxBytes)
+	rs := make([]*Reassembler, 8)
+	for i := range rs {
+		rs[i] = NewReassembler(time.Minute, maxBytes, budget)
+	}
+	for i := uint32(0); i < 1000; i++ {
+		for _, r := range rs {
+			r.Add(fragmentPacket(i, 0, 4, make([]byte, 1000)))
+		}
+		if budget.used > maxBytes {
+			t.Fatalf("group %d: %d bytes over the shared cap", i, budget.used)
+		}
+	}
+	total := 0
+	for _, r := range rs {
+		total += r.bytes
+	}
+	if int64(total) != budget.used {
+		t.Fatalf("reassemblers hold %d bytes, budget counts %d", total, budget.used)
+	}
+
+	// a reassembler evicts its own groups to make room, never another's
+	before := rs[1].bytes
+	rs[0].Add(fragmentPacket(5000, 0, 4, make([]byte, 1000)))
+	if _, ok := rs[0].groups[5000]; !ok || rs[1].bytes != before {
+		t.Fatal("new group not admitted by evicting its own")
+	}
+
+	// closing releases the shared bytes and later fragments are dropped
+	for _, r := range rs {
+		r.Close()
+	}
+	if budget.used != 0 {
+		t.Fatalf("%d bytes left after Close", budget.used)
+	}
+	rs[0].Add(fragmentPacket(6000, 0, 4, make([]byte, 1000)))
+	if budget.used != 0 || len(rs[0].groups) != 0 {
+		t.Fatal("group added after Close")
+	}
+}
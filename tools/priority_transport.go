@@ -0,0 +1,227 @@
+package tools
+
+import (
+	"context"
+	"github.com/golang/glog"
+	"reflect"
+)
+
+/**
+ * @brief: 多优先级数据传输，单消费者
+ * 下标越小优先级越高，消费时总是先取高优先级通道的数据；
+ * 低优先级通道有数据时，连续处理starve个更高优先级数据后，至少处理一个该通道的数据，避免饿死
+ */
+type PriorityTransport struct {
+	lanes   []chan interface{}   // 各优先级数据通道
+	skipped []int                // 各通道有数据但被跳过的次数
+	starve  int                  // 防饿死阈值
+	ctx     context.Context      // 上下文
+	cancel  context.CancelFunc   // cancel 函数
+}
+
+/**
+ * @brief: 创建多优先级数据传输
+ * @param1 caps: 各优先级通道容量，下标越小优先级越高
+ * @param2 starve: 防饿死阈值，<=0时默认16
+ */
+func NewPriorityTransport(caps []int, starve int)*PriorityTransport{
+	if len(caps) == 0 {
+		caps = []int{1000}
+	}
+	if starve <= 0 {
+		starve = 16
+	}
+
+	pt := &PriorityTransport{
+		lanes:   make([]chan interface{}, len(caps)),
+		skipped: make([]int, len(caps)),
+		starve:  starve,
+	}
+	for i := range caps {
+		c := caps[i]
+		if c <= 0 {
+			c = 1000
+		}
+		pt.lanes[i] = make(chan interface{}, c)
+	}
+	pt.ctx, pt.cancel = context.WithCancel(context.Background())
+
+	return pt
+}
+
+/**
+ * @brief: 取消
+ */
+func (pt *PriorityTransport)Cancel(){
+	if pt.cancel != nil{
+		pt.cancel()
+	}
+
+	for i := range pt.lanes{
+		close(pt.lanes[i])
+	}
+}
+
+/**
+ * @brief: 数据生产，通道已满时阻塞
+ * @param1 data: 数据
+ * @param2 lane: 优先级通道下标，超出范围时使用最低优先级
+ */
+func (pt *PriorityTransport)Produce(data interface{}, lane int){
+	if data == nil{
+		return
+	}
+
+	defer func() {
+		if x := recover(); x != nil {
+			glog.Errorln("PriorityTransport.Produce recover:", x)
+		}
+	}()
+
+	if lane < 0 {
+		lane = 0
+	}
+	if lane >= len(pt.lanes) {
+		lane = len(pt.lanes) - 1
+	}
+	pt.lanes[lane] <- data
+}
+
+/**
+ * @brief: 非阻塞数据生产
+ * @param1 data: 数据
+ * @param2 lane: 优先级通道下标，超出范围时使用最低优先级
+ * @return1: 通道已满或已取消时返回false
+ */
+func (pt *PriorityTransport)TryProduce(data interface{}, lane int)(ok bool){
+	if data == nil{
+		return true
+	}
+
+	defer func() {
+		if x := recover(); x != nil {
+			glog.Errorln("PriorityTransport.TryProduce recover:", x)
+			ok = false
+		}
+	}()
+
+	if lane < 0 {
+		lane = 0
+	}
+	if lane >= len(pt.lanes) {
+		lane = len(pt.lanes) - 1
+	}
+	select {
+	case pt.lanes[lane] <- data:
+		return true
+	default:
+		return false
+	}
+}
+
+/**
+ * @brief: 按优先级非阻塞取出下一个数据，由调用方自行消费时使用；与Consume同时使用时只能在Consume回调中调用
+ * @return2: 没有数据时返回false
+ */
+func (pt *PriorityTransport)Next()(interface{}, bool){
+	return pt.next()
+}
+
+/**
+ * @brief: 各优先级通道当前积压的数据数量
+ */
+func (pt *PriorityTransport)Depths()[]int{
+	depths := make([]int, len(pt.lanes))
+	for i := range pt.lanes{
+		depths[i] = len(pt.lanes[i])
+	}
+	return depths
+}
+
+/**
+ * @brief: 数据消费，启动一个消费协程
+ * @param1 cb: 回调函数, 返回false可以终端整个消费流程
+ */
+func (pt *PriorityTransport)Consume(cb func(interface{})bool){
+	if cb == nil{
+		glog.Errorln("Consume参数为nil")
+		return
+	}
+
+	go func() {
+		defer func() {
+			if x := recover(); x != nil {
+				glog.Errorln("PriorityTransport.Consume recover:", x)
+			}
+		}()
+
+		// 所有通道都为空时阻塞等待任意通道
+		cases := make([]reflect.SelectCase, len(pt.lanes) + 1)
+		cases[0] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(pt.ctx.Done())}
+		for i := range pt.lanes {
+			cases[i + 1] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(pt.lanes[i])}
+		}
+
+		for{
+			select {
+			case <-pt.ctx.Done():
+				glog.Infoln("PriorityTransport.Consume ctx.Done")
+				return
+			default:
+			}
+
+			data, ok := pt.next()
+			if !ok {
+				chosen, v, recvOk := reflect.Select(cases)
+				if chosen == 0 || !recvOk {
+					glog.Infoln("PriorityTransport.Consume ctx.Done")
+					return
+				}
+				data = v.Interface()
+			}
+			if !cb(data){
+				return
+			}
+		}
+	}()
+}
+
+/**
+ * @brief: 按优先级非阻塞取出下一个数据
+ */
+func (pt *PriorityTransport)next()(interface{}, bool){
+	// 被跳过次数达到阈值的低优先级通道优先
+	for i := len(pt.lanes) - 1; i > 0; i-- {
+		if pt.skipped[i] >= pt.starve && len(pt.lanes[i]) > 0 {
+			pt.skipped[i] = 0
+			return pt.recv(i)
+		}
+	}
+
+	for i := range pt.lanes {
+		if len(pt.lanes[i]) == 0 {
+			continue
+		}
+		for j := i + 1; j < len(pt.lanes); j++ {
+			if len(pt.lanes[j]) > 0 {
+				pt.skipped[j]++
+			}
+		}
+		pt.skipped[i] = 0
+		return pt.recv(i)
+	}
+
+	return nil, false
+}
+
+/**
+ * @brief: 从指定通道取出一个数据，通道已关闭时返回false
+ */
+func (pt *PriorityTransport)recv(i int)(interface{}, bool){
+	select {
+	case data, ok := <-pt.lanes[i]:
+		return data, ok
+	default:
+		return nil, false
+	}
+}
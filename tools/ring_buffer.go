@@ -6,6 +6,7 @@ package tools
 
 import (
 	"errors"
+	"io"
 	"sync"
 	"unsafe"
 )
@@ -18,22 +19,48 @@ var (
 
 // RingBuffer is a circular buffer that implement io.ReaderWriter interface.
 type RingBuffer struct {
-	buf    []byte
-	size   int
-	r      int // next position to read
-	w      int // next position to write
-	isFull bool
-	mu     sync.Mutex
+	buf     []byte
+	size    int
+	r       int // next position to read
+	w       int // next position to write
+	isFull  bool
+	maxSize int // the buffer grows up to maxSize when there is not enough free space
+	mu      sync.Mutex
 }
 
 // New returns a new RingBuffer whose buffer has the given size.
+// The underlying buffer is taken from the byte pool, call Release to give it back.
 func NewRingBuffer(size int) *RingBuffer {
+	return NewGrowableRingBuffer(size, size)
+}
+
+// NewGrowableRingBuffer returns a new RingBuffer whose buffer starts with the given size
+// and automatically grows, by doubling, up to maxSize when a write does not fit.
+// Growing moves the available data to the front of a new buffer taken from the byte pool.
+func NewGrowableRingBuffer(size, maxSize int) *RingBuffer {
+	if maxSize < size {
+		maxSize = size
+	}
 	return &RingBuffer{
-		buf:  make([]byte, size),
-		size: size,
+		buf:     GetBytes(size),
+		size:    size,
+		maxSize: maxSize,
 	}
 }
 
+// Release returns the underlying buffer to the byte pool. The RingBuffer must not be used afterwards.
+func (r *RingBuffer) Release() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	PutBytes(r.buf)
+	r.buf = nil
+	r.size = 0
+	r.r = 0
+	r.w = 0
+	r.isFull = false
+}
+
 // Read reads up to len(p) bytes into p. It returns the number of bytes read (0 <= n <= len(p)) and any error encountered. Even if Read returns n < len(p), it may use all of p as scratch space during the call. If some data is available but not len(p) bytes, Read conventionally returns what is available instead of waiting for more.
 // When Read encounters an error or end-of-file condition after successfully reading n > 0 bytes, it returns the number of bytes read. It may return the (non-nil) error from the same call or return the error (and n == 0) from a subsequent call.
 // Callers should always process the n > 0 bytes returned before considering the error err. Doing so correctly handles I/O errors that happen after reading some bytes and also both of the allowed EOF behaviors.
@@ -106,18 +133,15 @@ func (r *RingBuffer) Write(p []byte) (n int, err error) {
 		return 0, nil
 	}
 	r.mu.Lock()
+	if len(p) > r.free() {
+		r.grow(r.length() + len(p))
+	}
 	if r.w == r.r && r.isFull {
 		r.mu.Unlock()
 		return 0, ErrIsFull
 	}
 
-	var avail int
-	if r.w >= r.r {
-		avail = r.size - r.w + r.r
-	} else {
-		avail = r.r - r.w
-	}
-
+	avail := r.free()
 	if len(p) > avail {
 		err = ErrTooManyDataToWrite
 		p = p[:avail]
@@ -154,6 +178,9 @@ func (r *RingBuffer) Write(p []byte) (n int, err error) {
 // WriteByte writes one byte into buffer, and returns ErrIsFull if buffer is full.
 func (r *RingBuffer) WriteByte(c byte) error {
 	r.mu.Lock()
+	if r.w == r.r && r.isFull {
+		r.grow(r.size + 1)
+	}
 	if r.w == r.r && r.isFull {
 		r.mu.Unlock()
 		return ErrIsFull
@@ -177,6 +204,10 @@ func (r *RingBuffer) Length() int {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
+	return r.length()
+}
+
+func (r *RingBuffer) length() int {
 	if r.w == r.r {
 		if r.isFull {
 			return r.size
@@ -193,14 +224,29 @@ func (r *RingBuffer) Length() int {
 
 // Capacity returns the size of the underlying buffer.
 func (r *RingBuffer) Capacity() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	return r.size
 }
 
-// Free returns the length of available bytes to write.
+// MaxCapacity returns the size the underlying buffer may grow up to.
+func (r *RingBuffer) MaxCapacity() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.maxSize
+}
+
+// Free returns the length of available bytes to write, not counting the room the buffer may still grow.
 func (r *RingBuffer) Free() int {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
+	return r.free()
+}
+
+func (r *RingBuffer) free() int {
 	if r.w == r.r {
 		if r.isFull {
 			return 0
@@ -258,6 +304,176 @@ func (r *RingBuffer) Bytes() []byte {
 	return buf
 }
 
+// Peek returns up to n available read bytes without copying and without moving the read pointer.
+// The data may wrap around the end of the buffer, so it is returned as two slices, head is followed by tail.
+// Both slices alias the underlying buffer and are only valid until the next Write, Fill, Discard or Reset.
+func (r *RingBuffer) Peek(n int) (head []byte, tail []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if n <= 0 || (r.w == r.r && !r.isFull) {
+		return nil, nil
+	}
+
+	if r.w > r.r {
+		if n > r.w-r.r {
+			n = r.w - r.r
+		}
+		return r.buf[r.r : r.r+n], nil
+	}
+
+	if m := r.size - r.r + r.w; n > m {
+		n = m
+	}
+	if r.r+n <= r.size {
+		return r.buf[r.r : r.r+n], nil
+	}
+	return r.buf[r.r:r.size], r.buf[0 : n-(r.size-r.r)]
+}
+
+// Discard skips the next n available read bytes. It returns the number of bytes discarded.
+// When the buffer becomes empty, the read and write pointers are moved back to zero
+// so that the following data is laid out contiguously.
+func (r *RingBuffer) Discard(n int) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if n <= 0 {
+		return 0
+	}
+
+	avail := r.length()
+	if avail == 0 {
+		return 0
+	}
+	if n > avail {
+		n = avail
+	}
+
+	r.r = (r.r + n) % r.size
+	r.isFull = false
+	if r.r == r.w {
+		r.r = 0
+		r.w = 0
+	}
+	return n
+}
+
+// Fill calls rd.Read once, reading directly into the free space of the buffer without an intermediate copy.
+// At most the contiguous free space after the write pointer is used.
+// If the buffer is full it grows first, and ErrIsFull is returned when it has already reached its maximum size.
+// The lock is not held while reading, so Fill must only be used by the goroutine that owns the buffer.
+func (r *RingBuffer) Fill(rd io.Reader) (n int, err error) {
+	r.mu.Lock()
+	if r.w == r.r && r.isFull {
+		r.grow(r.size + 1)
+	}
+	if r.w == r.r && r.isFull {
+		r.mu.Unlock()
+		return 0, ErrIsFull
+	}
+
+	var free []byte
+	if r.w >= r.r {
+		free = r.buf[r.w:r.size]
+	} else {
+		free = r.buf[r.w:r.r]
+	}
+	r.mu.Unlock()
+
+	n, err = rd.Read(free)
+	if n <= 0 {
+		return 0, err
+	}
+
+	r.mu.Lock()
+	r.w += n
+	if r.w == r.size {
+		r.w = 0
+	}
+	if r.w == r.r {
+		r.isFull = true
+	}
+	r.mu.Unlock()
+
+	return n, err
+}
+
+// ReadFrom implements io.ReaderFrom. It reads data from rd into the buffer until EOF or an error occurs,
+// growing the buffer when needed. It returns ErrIsFull if the buffer reaches its maximum size before EOF.
+// Like Fill, it must only be used by the goroutine that owns the buffer.
+func (r *RingBuffer) ReadFrom(rd io.Reader) (n int64, err error) {
+	for {
+		m, e := r.Fill(rd)
+		n += int64(m)
+		if e == io.EOF {
+			return n, nil
+		}
+		if e != nil {
+			return n, e
+		}
+	}
+}
+
+// WriteTo implements io.WriterTo. It writes all available read bytes to w without an intermediate copy
+// and moves the read pointer past the bytes written.
+func (r *RingBuffer) WriteTo(w io.Writer) (n int64, err error) {
+	head, tail := r.Peek(r.Length())
+	for _, p := range [][]byte{head, tail} {
+		if len(p) == 0 {
+			continue
+		}
+		m, e := w.Write(p)
+		n += int64(m)
+		if e == nil && m < len(p) {
+			e = io.ErrShortWrite
+		}
+		if e != nil {
+			r.Discard(int(n))
+			return n, e
+		}
+	}
+	r.Discard(int(n))
+	return n, nil
+}
+
+// grow enlarges the underlying buffer, by doubling, so that it can hold need bytes, limited to maxSize.
+// The available data is moved to the front of the new buffer. It must be called with the lock held.
+func (r *RingBuffer) grow(need int) {
+	if need <= r.size || r.size >= r.maxSize {
+		return
+	}
+
+	newSize := r.size
+	if newSize <= 0 {
+		newSize = need
+	}
+	for newSize < need {
+		newSize *= 2
+	}
+	if newSize > r.maxSize {
+		newSize = r.maxSize
+	}
+
+	buf := GetBytes(newSize)
+	n := r.length()
+	if n > 0 {
+		if r.w > r.r {
+			copy(buf, r.buf[r.r:r.w])
+		} else {
+			c1 := copy(buf, r.buf[r.r:r.size])
+			copy(buf[c1:], r.buf[0:r.w])
+		}
+	}
+	PutBytes(r.buf)
+
+	r.buf = buf
+	r.size = newSize
+	r.r = 0
+	r.w = n % newSize
+	r.isFull = n == newSize
+}
+
 // IsFull returns this ringbuffer is full.
 func (r *RingBuffer) IsFull() bool {
 	r.mu.Lock()
@@ -0,0 +1,350 @@
+package tools
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var ringBufferImpls = []struct {
+	name string
+	new  func(size int) IRingBuffer
+}{
+	{"RingBuffer", func(size int) IRingBuffer { return NewRingBuffer(size) }},
+	{"SpscRingBuffer", func(size int) IRingBuffer { return NewSpscRingBuffer(size) }},
+}
+
+func peekString(rb IRingBuffer, n int) string {
+	head, tail := rb.Peek(n)
+	return string(head) + string(tail)
+}
+
+func TestRingBufferPeekDiscardWrap(t *testing.T) {
+	for _, impl := range ringBufferImpls {
+		t.Run(impl.name, func(t *testing.T) {
+			rb := impl.new(8)
+			defer rb.Release()
+
+			rb.Write([]byte("abcdef"))
+			if n := rb.Discard(5); n != 5 {
+				t.Fatalf("Discard(5) = %d", n)
+			}
+			// "f" is left at index 5, the next write wraps around the end
+			if n, err := rb.Write([]byte("ghijk")); n != 5 || err != nil {
+				t.Fatalf("Write = %d, %v", n, err)
+			}
+
+			head, tail := rb.Peek(10)
+			if string(head) != "fgh" || string(tail) != "ijk" {
+				t.Fatalf("Peek(10) = %q, %q", head, tail)
+			}
+			if s := peekString(rb, 4); s != "fghi" {
+				t.Fatalf("Peek(4) = %q", s)
+			}
+			if s := peekString(rb, 2); s != "fg" {
+				t.Fatalf("Peek(2) = %q", s)
+			}
+			if rb.Length() != 6 {
+				t.Fatalf("Length = %d", rb.Length())
+			}
+
+			// discard across the end of the buffer
+			if n := rb.Discard(4); n != 4 {
+				t.Fatalf("Discard(4) = %d", n)
+			}
+			if s := peekString(rb, 10); s != "jk" {
+				t.Fatalf("Peek after Discard = %q", s)
+			}
+			if n := rb.Discard(10); n != 2 {
+				t.Fatalf("Discard(10) = %d", n)
+			}
+			if !rb.IsEmpty() {
+				t.Fatal("not empty")
+			}
+			if head, tail := rb.Peek(1); head != nil || tail != nil {
+				t.Fatalf("Peek on empty = %q, %q", head, tail)
+			}
+			if n := rb.Discard(1); n != 0 {
+				t.Fatalf("Discard on empty = %d", n)
+			}
+		})
+	}
+}
+
+func TestRingBufferFillWrap(t *testing.T) {
+	for _, impl := range ringBufferImpls {
+		t.Run(impl.name, func(t *testing.T) {
+			rb := impl.new(8)
+			defer rb.Release()
+
+			rb.Write([]byte("abcdefgh"))
+			rb.Discard(6)
+			rb.Write([]byte("ij"))
+			// "ghij" occupies 6,7,0,1, the free space 2..5 is contiguous
+			src := strings.NewReader("klmnop")
+			if n, err := rb.Fill(src); n != 4 || err != nil {
+				t.Fatalf("Fill = %d, %v", n, err)
+			}
+			if !rb.IsFull() {
+				t.Fatal("not full")
+			}
+			if n, err := rb.Fill(src); n != 0 || err != ErrIsFull {
+				t.Fatalf("Fill on full = %d, %v", n, err)
+			}
+
+			rb.Discard(5)
+			// "lmn" occupies 3,4,5, Fill only uses the contiguous space after the write pointer
+			if n, err := rb.Fill(src); n != 2 || err != nil {
+				t.Fatalf("Fill after Discard = %d, %v", n, err)
+			}
+			if n, err := rb.Fill(src); n != 0 || err != io.EOF {
+				t.Fatalf("Fill at EOF = %d, %v", n, err)
+			}
+
+			var out bytes.Buffer
+			if _, err := rb.WriteTo(&out); err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != "lmnop" {
+				t.Fatalf("content = %q", out.String())
+			}
+		})
+	}
+}
+
+func TestRingBufferRandomOps(t *testing.T) {
+	for _, impl := range ringBufferImpls {
+		t.Run(impl.name, func(t *testing.T) {
+			rb := impl.new(16)
+			defer rb.Release()
+
+			rnd := rand.New(rand.NewSource(1))
+			var model []byte
+			next := byte(0)
+			for i := 0; i < 10000; i++ {
+				switch rnd.Intn(3) {
+				case 0:
+					p := make([]byte, rnd.Intn(8))
+					for j := range p {
+						p[j] = next
+						next++
+					}
+					n, _ := rb.Write(p)
+					model = append(model, p[:n]...)
+				case 1:
+					n := rnd.Intn(10)
+					want := model
+					if n < len(want) {
+						want = want[:n]
+					}
+					if got := peekString(rb, n); got != string(want) {
+						t.Fatalf("op %d: Peek(%d) = %v, want %v", i, n, []byte(got), want)
+					}
+				case 2:
+					n := rb.Discard(rnd.Intn(10))
+					model = model[n:]
+				}
+				if rb.Length() != len(model) {
+					t.Fatalf("op %d: Length = %d, want %d", i, rb.Length(), len(model))
+				}
+			}
+		})
+	}
+}
+
+func TestSpscRingBufferConcurrent(t *testing.T) {
+	rb := NewSpscRingBuffer(64)
+	defer rb.Release()
+
+	const total = 1 << 16
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < total; {
+			if err := rb.WriteByte(byte(i)); err != nil {
+				runtime.Gosched()
+				continue
+			}
+			i++
+		}
+	}()
+
+	for i := 0; i < total; {
+		head, tail := rb.Peek(16)
+		for _, p := range [][]byte{head, tail} {
+			for _, b := range p {
+				if b != byte(i) {
+					t.Fatalf("byte %d = %d", i, b)
+				}
+				i++
+			}
+		}
+		if rb.Discard(len(head)+len(tail)) == 0 {
+			runtime.Gosched()
+		}
+	}
+	wg.Wait()
+}
+
+func TestRingBufferGrow(t *testing.T) {
+	impls := []struct {
+		name string
+		new  func(size, maxSize int) IRingBuffer
+	}{
+		{"RingBuffer", func(size, maxSize int) IRingBuffer { return NewGrowableRingBuffer(size, maxSize) }},
+		{"SpscRingBuffer", func(size, maxSize int) IRingBuffer { return NewGrowableSpscRingBuffer(size, maxSize) }},
+	}
+	for _, impl := range impls {
+		t.Run(impl.name, func(t *testing.T) {
+			rb := impl.new(8, 64)
+			defer rb.Release()
+
+			// wrap around before growing
+			rb.Write([]byte("abcdef"))
+			rb.Discard(4)
+			rb.Write([]byte("ghijk"))
+			if rb.Capacity() != 8 {
+				t.Fatalf("Capacity = %d before growing", rb.Capacity())
+			}
+			if n, err := rb.Write([]byte("lmnopqrstu")); n != 10 || err != nil {
+				t.Fatalf("Write = %d, %v", n, err)
+			}
+			if rb.Capacity() != 32 {
+				t.Fatalf("Capacity = %d, want 32", rb.Capacity())
+			}
+			if s := peekString(rb, 100); s != "efghijklmnopqrstu" {
+				t.Fatalf("content = %q", s)
+			}
+
+			// Fill grows a full buffer
+			rb.Write(make([]byte, rb.Free()))
+			if n, err := rb.Fill(strings.NewReader("v")); n != 1 || err != nil {
+				t.Fatalf("Fill on full = %d, %v", n, err)
+			}
+			if rb.Capacity() != 64 || rb.MaxCapacity() != 64 {
+				t.Fatalf("Capacity = %d, MaxCapacity = %d", rb.Capacity(), rb.MaxCapacity())
+			}
+			if s := peekString(rb, 17); s != "efghijklmnopqrstu" {
+				t.Fatalf("content after Fill = %q", s)
+			}
+			rb.Write(make([]byte, rb.Free()))
+			if n, err := rb.Fill(strings.NewReader("w")); n != 0 || err != ErrIsFull {
+				t.Fatalf("Fill at max = %d, %v", n, err)
+			}
+		})
+	}
+}
+
+// the producer grows the buffer while the consumer keeps reading
+func TestSpscRingBufferGrowConcurrent(t *testing.T) {
+	rb := NewGrowableSpscRingBuffer(16, 1<<16)
+	defer rb.Release()
+
+	const total = 1 << 18
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		p := make([]byte, 0, 4096)
+		for i := 0; i < total; {
+			// bursts of increasing size force the buffer to grow
+			p = p[:0]
+			for j := 0; j < 1+i%4000 && i+j < total; j++ {
+				p = append(p, byte(i+j))
+			}
+			n, _ := rb.Write(p)
+			if n == 0 {
+				runtime.Gosched()
+			}
+			i += n
+		}
+	}()
+
+	for i := 0; i < total; {
+		head, tail := rb.Peek(1024)
+		for _, p := range [][]byte{head, tail} {
+			for _, b := range p {
+				if b != byte(i) {
+					t.Fatalf("byte %d = %d", i, b)
+				}
+				i++
+			}
+		}
+		if rb.Discard(len(head)+len(tail)) == 0 {
+			runtime.Gosched()
+		}
+	}
+	wg.Wait()
+	if rb.Capacity() <= 16 {
+		t.Fatalf("Capacity = %d, the buffer did not grow", rb.Capacity())
+	}
+}
+
+func benchmarkRingBuffer(b *testing.B, rb IRingBuffer, chunk int) {
+	defer rb.Release()
+
+	data := make([]byte, chunk)
+	b.SetBytes(int64(chunk))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rb.Write(data)
+		head, tail := rb.Peek(chunk)
+		rb.Discard(len(head) + len(tail))
+	}
+}
+
+func BenchmarkRingBuffer(b *testing.B) {
+	benchmarkRingBuffer(b, NewRingBuffer(64*1024), 1000)
+}
+
+func BenchmarkSpscRingBuffer(b *testing.B) {
+	benchmarkRingBuffer(b, NewSpscRingBuffer(64*1024), 1000)
+}
+
+// one producer goroutine and one consumer goroutine, as used by a tcp connection
+func benchmarkRingBufferConcurrent(b *testing.B, rb IRingBuffer, chunk int) {
+	defer rb.Release()
+
+	data := make([]byte, chunk)
+	total := b.N * chunk
+	b.SetBytes(int64(chunk))
+	b.ResetTimer()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for read := 0; read < total; {
+			head, tail := rb.Peek(total - read)
+			n := rb.Discard(len(head) + len(tail))
+			if n == 0 {
+				runtime.Gosched()
+			}
+			read += n
+		}
+	}()
+	for written := 0; written < total; {
+		p := data
+		if total-written < len(p) {
+			p = p[:total-written]
+		}
+		n, _ := rb.Write(p)
+		if n == 0 {
+			runtime.Gosched()
+		}
+		written += n
+	}
+	<-done
+}
+
+func BenchmarkRingBufferConcurrent(b *testing.B) {
+	benchmarkRingBufferConcurrent(b, NewRingBuffer(64*1024), 1000)
+}
+
+func BenchmarkSpscRingBufferConcurrent(b *testing.B) {
+	benchmarkRingBufferConcurrent(b, NewSpscRingBuffer(64*1024), 1000)
+}
@@ -0,0 +1,612 @@
+package tools
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	rudpCmdData    = 1                      // 数据段
+	rudpCmdAck     = 2                      // 确认段
+	rudpCmdRst     = 3                      // 重置段，收到发给本端以前实例的段时回复
+	rudpHeaderSize = 23                     // 段头长度：cmd(1) frg(2) wnd(2) conv(4) dst(4) sn(4) una(4) len(2)
+	rudpRtoDefault = 500 * time.Millisecond // 初始重传超时
+	rudpRtoMin     = 100 * time.Millisecond // 最小重传超时
+	rudpRtoMax     = 10 * time.Second       // 最大重传超时
+	rudpFastResend = 3                      // 被后续确认跳过该次数后快速重传
+	rudpDeadLink   = 20                     // 单个数据段重传该次数后认为链路断开
+	rudpInitCwnd   = 2                      // 初始拥塞窗口
+)
+
+var (
+	ErrRudpClosed   = errors.New("rudp is closed")
+	ErrRudpDeadLink = errors.New("rudp dead link")
+	ErrRudpTooLarge = errors.New("rudp message is too large")
+	ErrRudpBadPacket = errors.New("rudp bad packet")
+	ErrRudpReset    = errors.New("rudp peer reset")
+)
+
+/**
+ * @brief: 数据段
+ */
+type rudpSegment struct {
+	sn       uint32        // 序号
+	frg      uint16        // 消息剩余分片数，0表示消息最后一个分片
+	data     []byte        // 数据
+	sendAt   time.Time     // 最后发送时间
+	resendAt time.Time     // 超时重传时间
+	rto      time.Duration // 该段当前重传超时
+	xmit     int           // 发送次数
+	fastack  int           // 被后续确认跳过的次数
+}
+
+/**
+ * @brief: 可靠有序udp协议，选择确认+超时重传+快速重传+拥塞窗口
+ * 只负责协议状态，不做收发：发送的数据报通过output输出，收到的数据报由调用方交给Input，
+ * 需要周期调用Update驱动重传；消息按发送顺序完整交付
+ * 每个udp数据报可以包含多个段，段格式：cmd(1) frg(2) wnd(2) conv(4) dst(4) sn(4) una(4) len(2) data(len)，大端序
+ * conv为发送端实例的随机id，dst为发送端已知的对端conv（未收到过对端数据时为0）：
+ * dst不是本端conv的段属于本端以前的实例，丢弃并回复重置段；对端conv变化或者收到重置段说明对端已重启，
+ * 序号和确认都不再有效，会话进入重置状态，Input、Update、Send返回ErrRudpReset，需要关闭后重新创建
+ */
+type Rudp struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	output   func([]byte)     // 输出数据报，需要同步发送，返回后缓冲区即被复用
+	mtu      int              // 单个数据报最大长度
+	mss      int              // 单个数据段最大数据长度
+	wnd      int              // 收发窗口，数据段数
+	conv     uint32           // 本端实例id
+	rmtConv  uint32           // 对端实例id，0表示还未收到对端数据
+	rstTo    uint32           // 需要回复重置段的对端实例id，0表示不需要
+	sndQueue []*rudpSegment   // 等待进入发送窗口的数据段
+	sndBuf   []*rudpSegment   // 已发送未确认的数据段，按序号排列
+	sndNxt   uint32           // 下一个发送序号
+	sndUna   uint32           // 最小未确认序号
+	rcvNxt   uint32           // 下一个待交付序号
+	rcvBuf   map[uint32]*rudpSegment // 已收到未交付的数据段
+	frags    [][]byte         // 正在组装的消息分片
+	rmtWnd   int              // 对端接收窗口
+	cwnd     int              // 拥塞窗口
+	incr     int              // 拥塞避免阶段累计确认数
+	ssthresh int              // 慢启动阈值
+	srtt     time.Duration    // 平滑往返时间
+	rttvar   time.Duration    // 往返时间偏差
+	rto      time.Duration    // 重传超时
+	acks     []uint32         // 待发送确认的序号
+	buf      []byte           // 输出缓冲区
+	dead     bool             // 链路是否已断开
+	reset    bool             // 对端是否已重启
+	closed   bool             // 是否已关闭
+}
+
+/**
+ * @brief: 创建可靠udp协议
+ * @param1 mtu: 单个udp数据报最大长度，<=rudpHeaderSize时默认1400
+ * @param2 wnd: 收发窗口，数据段数，<=0时默认128
+ * @param3 output: 数据报输出函数，在持有锁时调用，需要同步发送且不能调用Rudp的方法
+ */
+func NewRudp(mtu, wnd int, output func([]byte))*Rudp{
+	if mtu <= rudpHeaderSize {
+		mtu = 1400
+	}
+	if wnd <= 0 {
+		wnd = 128
+	}
+
+	r := &Rudp{
+		output:   output,
+		mtu:      mtu,
+		mss:      mtu - rudpHeaderSize,
+		wnd:      wnd,
+		conv:     newRudpConv(),
+		rcvBuf:   make(map[uint32]*rudpSegment),
+		rmtWnd:   wnd,
+		cwnd:     rudpInitCwnd,
+		ssthresh: wnd,
+		rto:      rudpRtoDefault,
+		buf:      make([]byte, 0, mtu),
+	}
+	r.cond = sync.NewCond(&r.mu)
+	return r
+}
+
+/**
+ * @brief: 生成非0的随机实例id
+ */
+func newRudpConv()uint32{
+	var b [4]byte
+	for {
+		if _, err := rand.Read(b[:]); err != nil {
+			return uint32(time.Now().UnixNano()) | 1
+		}
+		if conv := binary.BigEndian.Uint32(b[:]); conv != 0 {
+			return conv
+		}
+	}
+}
+
+/**
+ * @brief: 发送消息，超过mss时分片，等待发送的数据段超过两倍窗口时阻塞
+ * @param1 data: 消息，确认前一直被引用，调用方不能修改
+ */
+func (r *Rudp)Send(data []byte)error{
+	count := (len(data) + r.mss - 1) / r.mss
+	if count == 0 {
+		count = 1
+	}
+	if count > 0xffff {
+		return ErrRudpTooLarge
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for !r.closed && !r.reset && len(r.sndQueue) + len(r.sndBuf) >= 2 * r.wnd {
+		r.cond.Wait()
+	}
+	if r.closed {
+		return ErrRudpClosed
+	}
+	if r.reset {
+		return ErrRudpReset
+	}
+
+	for i := 0; i < count; i++ {
+		end := (i + 1) * r.mss
+		if end > len(data) {
+			end = len(data)
+		}
+		r.sndQueue = append(r.sndQueue, &rudpSegment{
+			frg:  uint16(count - 1 - i),
+			data: data[i * r.mss:end],
+		})
+	}
+	r.flush()
+	return nil
+}
+
+/**
+ * @brief: 处理收到的数据报
+ * @param1 pkt: 数据报，返回后不再引用
+ * @param2 deliver: 按顺序交付完整消息，在释放锁后调用，可以在其中调用Send
+ */
+func (r *Rudp)Input(pkt []byte, deliver func([]byte))error{
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return ErrRudpClosed
+	}
+	if r.reset {
+		r.mu.Unlock()
+		return ErrRudpReset
+	}
+
+	var err error
+	maxAck, hasAck := uint32(0), false
+	for len(pkt) > 0 {
+		if len(pkt) < rudpHeaderSize {
+			err = ErrRudpBadPacket
+			break
+		}
+		cmd := pkt[0]
+		frg := binary.BigEndian.Uint16(pkt[1:])
+		wnd := binary.BigEndian.Uint16(pkt[3:])
+		conv := binary.BigEndian.Uint32(pkt[5:])
+		dst := binary.BigEndian.Uint32(pkt[9:])
+		sn := binary.BigEndian.Uint32(pkt[13:])
+		una := binary.BigEndian.Uint32(pkt[17:])
+		size := int(binary.BigEndian.Uint16(pkt[21:]))
+		if len(pkt) < rudpHeaderSize + size || conv == 0 {
+			err = ErrRudpBadPacket
+			break
+		}
+		body := pkt[rudpHeaderSize:rudpHeaderSize + size]
+		pkt = pkt[rudpHeaderSize + size:]
+
+		if dst != 0 && dst != r.conv {
+			// 发给本端以前实例的段，序号和确认都不属于本会话
+			if cmd != rudpCmdRst {
+				r.rstTo = conv
+			}
+			continue
+		}
+		if r.rmtConv == 0 {
+			r.rmtConv = conv
+		}
+		if conv != r.rmtConv || cmd == rudpCmdRst {
+			// 对端已重启，对端以前实例的消息无法再交付，本端未确认的消息也无法确认是否送达
+			r.reset = true
+			err = ErrRudpReset
+			break
+		}
+
+		r.rmtWnd = int(wnd)
+		r.ackUna(una)
+
+		switch cmd {
+		case rudpCmdAck:
+			for ; len(body) >= 4; body = body[4:] {
+				ack := binary.BigEndian.Uint32(body)
+				r.ackSn(ack)
+				if !hasAck || seqAfter(ack, maxAck) {
+					maxAck, hasAck = ack, true
+				}
+			}
+		case rudpCmdData:
+			if seqBefore(sn, r.rcvNxt) {
+				// 重复，对端没有收到确认，重新确认
+				r.acks = append(r.acks, sn)
+				continue
+			}
+			if !seqBefore(sn, r.rcvNxt + uint32(r.wnd)) {
+				// 超出窗口，丢弃且不确认，等待重传
+				continue
+			}
+			r.acks = append(r.acks, sn)
+			if _, ok := r.rcvBuf[sn]; !ok {
+				// 接收缓冲区会被复用，需要拷贝
+				data := make([]byte, len(body))
+				copy(data, body)
+				r.rcvBuf[sn] = &rudpSegment{sn: sn, frg: frg, data: data}
+			}
+		default:
+			err = ErrRudpBadPacket
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	if r.reset {
+		r.mu.Unlock()
+		// 唤醒阻塞的Send
+		r.cond.Broadcast()
+		return err
+	}
+
+	if hasAck {
+		// 序号小于最大确认序号的未确认段被跳过一次
+		for _, seg := range r.sndBuf {
+			if seqBefore(seg.sn, maxAck) {
+				seg.fastack++
+			}
+		}
+	}
+
+	msgs := r.receive()
+	r.flush()
+	r.mu.Unlock()
+
+	for _, msg := range msgs {
+		deliver(msg)
+	}
+	return err
+}
+
+/**
+ * @brief: 周期调用，处理超时重传、发送确认
+ * @return1: 链路断开或已关闭时返回错误
+ */
+func (r *Rudp)Update()error{
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return ErrRudpClosed
+	}
+	if r.reset {
+		return ErrRudpReset
+	}
+	r.flush()
+	if r.dead {
+		return ErrRudpDeadLink
+	}
+	return nil
+}
+
+/**
+ * @brief: 关闭，唤醒阻塞的Send
+ */
+func (r *Rudp)Close(){
+	r.mu.Lock()
+	r.closed = true
+	r.sndQueue = nil
+	r.sndBuf = nil
+	r.rcvBuf = nil
+	r.frags = nil
+	r.mu.Unlock()
+	r.cond.Broadcast()
+}
+
+/**
+ * @brief: 等待发送和等待确认的数据段数
+ */
+func (r *Rudp)WaitSnd()int{
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.sndQueue) + len(r.sndBuf)
+}
+
+/**
+ * @brief: 平滑往返时间
+ */
+func (r *Rudp)SRTT()time.Duration{
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.srtt
+}
+
+/**
+ * @brief: 确认小于una的所有数据段
+ */
+func (r *Rudp)ackUna(una uint32){
+	n := 0
+	for n < len(r.sndBuf) && seqBefore(r.sndBuf[n].sn, una) {
+		r.acked(r.sndBuf[n])
+		n++
+	}
+	if n > 0 {
+		r.sndBuf = r.sndBuf[n:]
+		r.updateUna()
+	}
+}
+
+/**
+ * @brief: 选择确认单个数据段
+ */
+func (r *Rudp)ackSn(sn uint32){
+	for i, seg := range r.sndBuf {
+		if seg.sn == sn {
+			r.acked(seg)
+			r.sndBuf = append(r.sndBuf[:i], r.sndBuf[i + 1:]...)
+			r.updateUna()
+			return
+		}
+		if seqAfter(seg.sn, sn) {
+			return
+		}
+	}
+}
+
+func (r *Rudp)updateUna(){
+	if len(r.sndBuf) > 0 {
+		r.sndUna = r.sndBuf[0].sn
+	} else {
+		r.sndUna = r.sndNxt
+	}
+	r.cond.Broadcast()
+}
+
+/**
+ * @brief: 数据段被确认，更新往返时间和拥塞窗口
+ */
+func (r *Rudp)acked(seg *rudpSegment){
+	if seg.xmit == 1 {
+		// 重传过的段无法确定对应哪次发送，不参与计算
+		r.updateRtt(time.Since(seg.sendAt))
+	}
+
+	if r.cwnd < r.ssthresh {
+		r.cwnd++
+	} else {
+		r.incr++
+		if r.incr >= r.cwnd {
+			r.cwnd++
+			r.incr = 0
+		}
+	}
+	if r.cwnd > r.wnd {
+		r.cwnd = r.wnd
+	}
+}
+
+func (r *Rudp)updateRtt(rtt time.Duration){
+	if r.srtt == 0 {
+		r.srtt = rtt
+		r.rttvar = rtt / 2
+	} else {
+		delta := rtt - r.srtt
+		if delta < 0 {
+			delta = -delta
+		}
+		r.rttvar = (3 * r.rttvar + delta) / 4
+		r.srtt = (7 * r.srtt + rtt) / 8
+	}
+
+	r.rto = r.srtt + 4 * r.rttvar
+	if r.rto < rudpRtoMin {
+		r.rto = rudpRtoMin
+	}
+	if r.rto > rudpRtoMax {
+		r.rto = rudpRtoMax
+	}
+}
+
+/**
+ * @brief: 按序取出已收到的数据段组装成消息
+ */
+func (r *Rudp)receive()[][]byte{
+	var msgs [][]byte
+	for {
+		seg, ok := r.rcvBuf[r.rcvNxt]
+		if !ok {
+			return msgs
+		}
+		delete(r.rcvBuf, r.rcvNxt)
+		r.rcvNxt++
+
+		r.frags = append(r.frags, seg.data)
+		if seg.frg != 0 {
+			continue
+		}
+		if len(r.frags) == 1 {
+			msgs = append(msgs, r.frags[0])
+		} else {
+			size := 0
+			for _, f := range r.frags {
+				size += len(f)
+			}
+			msg := make([]byte, 0, size)
+			for _, f := range r.frags {
+				msg = append(msg, f...)
+			}
+			msgs = append(msgs, msg)
+		}
+		r.frags = nil
+	}
+}
+
+/**
+ * @brief: 发送确认，新数据段进入发送窗口，发送新数据段和需要重传的数据段
+ */
+func (r *Rudp)flush(){
+	if r.closed || r.reset {
+		return
+	}
+	now := time.Now()
+
+	// 重置
+	if r.rstTo != 0 {
+		r.write(rudpCmdRst, r.rstTo, 0, 0, nil)
+		r.rstTo = 0
+	}
+
+	// 确认
+	for i := 0; i < len(r.acks); {
+		n := len(r.acks) - i
+		if limit := r.mss / 4; n > limit {
+			n = limit
+		}
+		body := make([]byte, n * 4)
+		for j := 0; j < n; j++ {
+			binary.BigEndian.PutUint32(body[j * 4:], r.acks[i + j])
+		}
+		i += n
+		r.write(rudpCmdAck, r.rmtConv, 0, 0, body)
+	}
+	r.acks = r.acks[:0]
+
+	// 发送窗口，对端窗口为0时仍允许一个数据段探测
+	cwnd := r.wnd
+	if r.rmtWnd < cwnd {
+		cwnd = r.rmtWnd
+	}
+	if r.cwnd < cwnd {
+		cwnd = r.cwnd
+	}
+	if cwnd < 1 {
+		cwnd = 1
+	}
+	for len(r.sndQueue) > 0 && seqBefore(r.sndNxt, r.sndUna + uint32(cwnd)) {
+		seg := r.sndQueue[0]
+		r.sndQueue[0] = nil
+		r.sndQueue = r.sndQueue[1:]
+		seg.sn = r.sndNxt
+		r.sndNxt++
+		r.sndBuf = append(r.sndBuf, seg)
+	}
+
+	lost, fast := false, false
+	for _, seg := range r.sndBuf {
+		send := false
+		if seg.xmit == 0 {
+			send = true
+			seg.rto = r.rto
+		} else if !now.Before(seg.resendAt) {
+			send = true
+			lost = true
+			// 退避1.5倍，比TCP的2倍更适合高丢包链路
+			seg.rto += seg.rto / 2
+			if seg.rto > rudpRtoMax {
+				seg.rto = rudpRtoMax
+			}
+		} else if seg.fastack >= rudpFastResend {
+			send = true
+			fast = true
+		}
+		if !send {
+			continue
+		}
+
+		seg.xmit++
+		seg.fastack = 0
+		seg.sendAt = now
+		seg.resendAt = now.Add(seg.rto)
+		if seg.xmit >= rudpDeadLink {
+			r.dead = true
+		}
+		r.write(rudpCmdData, r.rmtConv, seg.frg, seg.sn, seg.data)
+	}
+	r.output0()
+
+	// 拥塞控制
+	inflight := int(r.sndNxt - r.sndUna)
+	if fast {
+		r.ssthresh = inflight / 2
+		if r.ssthresh < 2 {
+			r.ssthresh = 2
+		}
+		r.cwnd = r.ssthresh + rudpFastResend
+		r.incr = 0
+	}
+	if lost {
+		r.ssthresh = r.cwnd / 2
+		if r.ssthresh < 2 {
+			r.ssthresh = 2
+		}
+		r.cwnd = 1
+		r.incr = 0
+	}
+}
+
+/**
+ * @brief: 写入一个段到输出缓冲区，放不下时先输出
+ * @param2 dst: 对端实例id
+ */
+func (r *Rudp)write(cmd byte, dst uint32, frg uint16, sn uint32, data []byte){
+	if len(r.buf) + rudpHeaderSize + len(data) > r.mtu {
+		r.output0()
+	}
+
+	wnd := r.wnd - len(r.rcvBuf)
+	if wnd < 0 {
+		wnd = 0
+	}
+	var h [rudpHeaderSize]byte
+	h[0] = cmd
+	binary.BigEndian.PutUint16(h[1:], frg)
+	binary.BigEndian.PutUint16(h[3:], uint16(wnd))
+	binary.BigEndian.PutUint32(h[5:], r.conv)
+	binary.BigEndian.PutUint32(h[9:], dst)
+	binary.BigEndian.PutUint32(h[13:], sn)
+	binary.BigEndian.PutUint32(h[17:], r.rcvNxt)
+	binary.BigEndian.PutUint16(h[21:], uint16(len(data)))
+	r.buf = append(r.buf, h[:]...)
+	r.buf = append(r.buf, data...)
+}
+
+/**
+ * @brief: 输出缓冲区中的数据报
+ */
+func (r *Rudp)output0(){
+	if len(r.buf) == 0 {
+		return
+	}
+	r.output(r.buf)
+	r.buf = r.buf[:0]
+}
+
+/**
+ * @brief: 序号比较，考虑回绕
+ */
+func seqBefore(a, b uint32)bool{
+	return int32(a - b) < 0
+}
+
+func seqAfter(a, b uint32)bool{
+	return int32(a - b) > 0
+}
@@ -0,0 +1,358 @@
+package tools
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+// rudpLink is a lossy, reordering datagram link between two endpoints
+type rudpLink struct {
+	mu      sync.Mutex
+	rnd     *rand.Rand
+	loss    float64 // probability of dropping a datagram
+	reorder int     // a datagram may overtake up to reorder queued datagrams
+	queue   [2][][]byte
+}
+
+func newRudpLink(loss float64, reorder int) *rudpLink {
+	return &rudpLink{rnd: rand.New(rand.NewSource(1)), loss: loss, reorder: reorder}
+}
+
+// output returns the output function of the endpoint sending towards side to
+func (l *rudpLink) output(to int) func([]byte) {
+	return func(pkt []byte) {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.rnd.Float64() < l.loss {
+			return
+		}
+		p := append([]byte(nil), pkt...)
+		q := l.queue[to]
+		pos := len(q)
+		if l.reorder > 0 {
+			pos -= l.rnd.Intn(l.reorder + 1)
+			if pos < 0 {
+				pos = 0
+			}
+		}
+		q = append(q, nil)
+		copy(q[pos+1:], q[pos:])
+		q[pos] = p
+		l.queue[to] = q
+	}
+}
+
+func (l *rudpLink) take(to int) [][]byte {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	q := l.queue[to]
+	l.queue[to] = nil
+	return q
+}
+
+// rudpPeer is one endpoint, the Rudp instance can be replaced to simulate a restart
+type rudpPeer struct {
+	mu   sync.Mutex
+	r    *Rudp
+	msgs [][]byte
+	errs []error
+}
+
+func (p *rudpPeer) get() *Rudp {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.r
+}
+
+func (p *rudpPeer) set(r *Rudp) {
+	p.mu.Lock()
+	p.r = r
+	p.mu.Unlock()
+}
+
+func (p *rudpPeer) deliver(msg []byte) {
+	p.mu.Lock()
+	p.msgs = append(p.msgs, msg)
+	p.mu.Unlock()
+}
+
+func (p *rudpPeer) received() [][]byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([][]byte(nil), p.msgs...)
+}
+
+func (p *rudpPeer) errors() []error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]error(nil), p.errs...)
+}
+
+type rudpPair struct {
+	link  *rudpLink
+	peers [2]*rudpPeer
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// newRudpPair connects two endpoints through link and drives them until close
+func newRudpPair(link *rudpLink, mtu, wnd int) *rudpPair {
+	p := &rudpPair{link: link, stop: make(chan struct{}), done: make(chan struct{})}
+	for i := range p.peers {
+		p.peers[i] = &rudpPeer{}
+		p.peers[i].set(NewRudp(mtu, wnd, link.output(1-i)))
+	}
+	go p.run()
+	return p
+}
+
+func (p *rudpPair) run() {
+	defer close(p.done)
+	ticker := time.NewTicker(5 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+		for i, peer := range p.peers {
+			r := peer.get()
+			for _, pkt := range p.link.take(i) {
+				if err := r.Input(pkt, peer.deliver); err != nil {
+					peer.mu.Lock()
+					peer.errs = append(peer.errs, err)
+					peer.mu.Unlock()
+				}
+			}
+			r.Update()
+		}
+	}
+}
+
+func (p *rudpPair) close() {
+	close(p.stop)
+	<-p.done
+	for _, peer := range p.peers {
+		peer.get().Close()
+	}
+}
+
+func rudpMessage(i, size int) []byte {
+	msg := bytes.Repeat([]byte{byte(i)}, size)
+	copy(msg, fmt.Sprintf("msg-%d:", i))
+	return msg
+}
+
+func waitRudp(t *testing.T, timeout time.Duration, cond func() bool) {
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// sendAll sends count messages from peer from to the other peer and checks they arrive complete and in order
+func sendAll(t *testing.T, p *rudpPair, from, count int, size func(i int) int) {
+	startSend(p, from, count, size)
+	checkReceived(t, p, from, count, size)
+}
+
+func startSend(p *rudpPair, from, count int, size func(i int) int) {
+	sender := p.peers[from].get()
+	go func() {
+		for i := 0; i < count; i++ {
+			if err := sender.Send(rudpMessage(i, size(i))); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+func checkReceived(t *testing.T, p *rudpPair, from, count int, size func(i int) int) {
+	sender := p.peers[from].get()
+	to := p.peers[1-from]
+	waitRudp(t, 30*time.Second, func() bool { return len(to.received()) >= count })
+	msgs := to.received()
+	if len(msgs) != count {
+		t.Fatalf("received %d messages, want %d", len(msgs), count)
+	}
+	for i, msg := range msgs {
+		if !bytes.Equal(msg, rudpMessage(i, size(i))) {
+			t.Fatalf("message %d corrupted or out of order: %.16q", i, msg)
+		}
+	}
+	waitRudp(t, 10*time.Second, func() bool { return sender.WaitSnd() == 0 })
+}
+
+func TestRudpReliable(t *testing.T) {
+	p := newRudpPair(newRudpLink(0, 0), 200, 32)
+	defer p.close()
+	sendAll(t, p, 0, 200, func(i int) int { return 100 })
+}
+
+func TestRudpFragments(t *testing.T) {
+	p := newRudpPair(newRudpLink(0, 0), 200, 32)
+	defer p.close()
+	// empty, exactly one mss, and multi-segment messages
+	mss := 200 - rudpHeaderSize
+	sizes := []int{0, 1, mss, mss + 1, 10 * mss, 3000}
+	sendAll(t, p, 0, 60, func(i int) int {
+		if i%len(sizes) == 0 {
+			return 16
+		}
+		return sizes[i%len(sizes)]
+	})
+}
+
+func TestRudpLoss(t *testing.T) {
+	p := newRudpPair(newRudpLink(0.1, 0), 200, 32)
+	defer p.close()
+	sendAll(t, p, 0, 100, func(i int) int { return 50 + i*7%400 })
+}
+
+func TestRudpReorder(t *testing.T) {
+	p := newRudpPair(newRudpLink(0, 4), 200, 32)
+	defer p.close()
+	sendAll(t, p, 0, 200, func(i int) int { return 50 + i*7%400 })
+}
+
+func TestRudpBothDirections(t *testing.T) {
+	p := newRudpPair(newRudpLink(0.05, 2), 200, 32)
+	defer p.close()
+	size := func(i int) int { return 300 }
+	startSend(p, 0, 100, size)
+	startSend(p, 1, 100, size)
+	checkReceived(t, p, 0, 100, size)
+	checkReceived(t, p, 1, 100, size)
+}
+
+// a restarted peer starts again at sn 0, the survivor must not take its segments as duplicates
+// nor acknowledge its messages with the old una
+func TestRudpPeerRestart(t *testing.T) {
+	link := newRudpLink(0, 0)
+	p := newRudpPair(link, 200, 32)
+	defer p.close()
+	sendAll(t, p, 0, 20, func(i int) int { return 100 })
+	sendAll(t, p, 1, 20, func(i int) int { return 100 })
+
+	// peer 0 restarts and sends 5 new messages
+	restarted := NewRudp(200, 32, link.output(1))
+	p.peers[0].set(restarted)
+	for i := 0; i < 5; i++ {
+		restarted.Send(rudpMessage(100+i, 100))
+	}
+
+	survivor := p.peers[1]
+	waitRudp(t, 5*time.Second, func() bool {
+		for _, err := range survivor.errors() {
+			if err == ErrRudpReset {
+				return true
+			}
+		}
+		return false
+	})
+	if n := len(survivor.received()); n != 20 {
+		t.Fatalf("survivor delivered %d messages of the restarted peer as old ones", n-20)
+	}
+	if err := survivor.get().Update(); err != ErrRudpReset {
+		t.Fatalf("Update after reset = %v", err)
+	}
+	if err := survivor.get().Send([]byte("x")); err != ErrRudpReset {
+		t.Fatalf("Send after reset = %v", err)
+	}
+	if restarted.WaitSnd() != 5 {
+		t.Fatalf("restarted peer WaitSnd = %d, its messages were acknowledged by the old session", restarted.WaitSnd())
+	}
+
+	// the survivor's owner replaces the session, the retransmissions are delivered to it
+	survivor.get().Close()
+	survivor.mu.Lock()
+	survivor.msgs = nil
+	survivor.mu.Unlock()
+	survivor.set(NewRudp(200, 32, link.output(0)))
+	waitRudp(t, 10*time.Second, func() bool { return len(survivor.received()) >= 5 })
+	for i, msg := range survivor.received() {
+		if !bytes.Equal(msg, rudpMessage(100+i, 100)) {
+			t.Fatalf("message %d after restart = %.16q", i, msg)
+		}
+	}
+	waitRudp(t, 5*time.Second, func() bool { return restarted.WaitSnd() == 0 })
+}
+
+// segments of the survivor addressed to the previous instance are dropped and answered with a reset
+func TestRudpStaleSegments(t *testing.T) {
+	link := newRudpLink(0, 0)
+	p := newRudpPair(link, 200, 32)
+	defer p.close()
+	sendAll(t, p, 0, 5, func(i int) int { return 100 })
+
+	// peer 1 restarts while peer 0 still has unacknowledged data for it
+	old := p.peers[1].get()
+	p.peers[1].set(NewRudp(200, 32, link.output(0)))
+	old.Close()
+	for i := 0; i < 3; i++ {
+		p.peers[0].get().Send(rudpMessage(i, 100))
+	}
+
+	waitRudp(t, 5*time.Second, func() bool {
+		for _, err := range p.peers[0].errors() {
+			if err == ErrRudpReset {
+				return true
+			}
+		}
+		return false
+	})
+	if n := len(p.peers[1].received()); n != 5 {
+		t.Fatalf("restarted peer delivered %d stale messages", n-5)
+	}
+}
+
+func TestRudpBadPacket(t *testing.T) {
+	r := NewRudp(200, 32, func([]byte) {})
+	defer r.Close()
+	deliver := func([]byte) { t.Fatal("delivered") }
+	if err := r.Input([]byte{1, 2, 3}, deliver); err != ErrRudpBadPacket {
+		t.Fatal(err)
+	}
+	// length beyond the datagram
+	pkt := make([]byte, rudpHeaderSize)
+	pkt[0] = rudpCmdData
+	pkt[8] = 1
+	pkt[22] = 10
+	if err := r.Input(pkt, deliver); err != ErrRudpBadPacket {
+		t.Fatal(err)
+	}
+	// conv 0
+	pkt[8] = 0
+	pkt[22] = 0
+	if err := r.Input(pkt, deliver); err != ErrRudpBadPacket {
+		t.Fatal(err)
+	}
+}
+
+// segments beyond the receive window are neither buffered nor acknowledged
+func TestRudpOutOfWindow(t *testing.T) {
+	var out [][]byte
+	r := NewRudp(200, 4, func(pkt []byte) { out = append(out, append([]byte(nil), pkt...)) })
+	defer r.Close()
+
+	pkt := make([]byte, rudpHeaderSize+1)
+	pkt[0] = rudpCmdData
+	pkt[8] = 1  // conv
+	pkt[16] = 9 // sn beyond rcvNxt+wnd
+	pkt[22] = 1
+	r.Input(pkt, func([]byte) { t.Fatal("delivered") })
+	if len(out) != 0 {
+		t.Fatal("out of window segment acknowledged")
+	}
+	if len(r.rcvBuf) != 0 {
+		t.Fatal("out of window segment buffered")
+	}
+}
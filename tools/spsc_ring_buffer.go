@@ -0,0 +1,388 @@
+package tools
+
+import (
+	"io"
+	"math/bits"
+	"sync/atomic"
+	"unsafe"
+)
+
+// IRingBuffer is the common API of RingBuffer and SpscRingBuffer.
+type IRingBuffer interface {
+	io.ReadWriter
+	io.ByteReader
+	io.ByteWriter
+	io.ReaderFrom
+	io.WriterTo
+	WriteString(s string) (n int, err error)
+	Peek(n int) (head []byte, tail []byte)
+	Discard(n int) int
+	Fill(rd io.Reader) (n int, err error)
+	Bytes() []byte
+	Length() int
+	Free() int
+	Capacity() int
+	MaxCapacity() int
+	IsFull() bool
+	IsEmpty() bool
+	Reset()
+	Release()
+}
+
+var (
+	_ IRingBuffer = (*RingBuffer)(nil)
+	_ IRingBuffer = (*SpscRingBuffer)(nil)
+)
+
+// NewIRingBuffer returns a buffer growing from size up to maxSize, a SpscRingBuffer if lockFree is set,
+// otherwise a RingBuffer.
+func NewIRingBuffer(size, maxSize int, lockFree bool) IRingBuffer {
+	if lockFree {
+		return NewGrowableSpscRingBuffer(size, maxSize)
+	}
+	return NewGrowableRingBuffer(size, maxSize)
+}
+
+const cacheLinePad = 64
+
+// SpscRingBuffer is a lock-free circular buffer for exactly one producer goroutine and one consumer goroutine.
+//
+// The read and write positions are free-running counters updated with atomic operations,
+// the capacity is a power of two so that positions are mapped onto the buffer with a mask.
+// Write, WriteByte, WriteString, Fill and ReadFrom may only be called by the producer,
+// Read, ReadByte, Peek, Discard, WriteTo, Bytes and Reset only by the consumer.
+// The remaining methods may be called from either side and return a snapshot.
+// Release must only be called when both sides are done.
+//
+// The producer grows the buffer, by doubling, up to its maximum size when a write does not fit.
+// It copies the available data into a new buffer and swaps it in, the old buffer is left unchanged
+// so that the consumer may keep reading it meanwhile. The old buffer goes back to the byte pool
+// only if the consumer has already read everything, otherwise it is left to the garbage collector.
+type SpscRingBuffer struct {
+	r       uint64 // next position to read, written by the consumer only
+	_       [cacheLinePad - 8]byte
+	w       uint64 // next position to write, written by the producer only
+	_       [cacheLinePad - 8]byte
+	b       unsafe.Pointer // *spscBuf, replaced by the producer when growing
+	maxSize uint64
+}
+
+// spscBuf is the underlying buffer of a SpscRingBuffer, position p is stored at buf[p&mask].
+type spscBuf struct {
+	buf  []byte
+	size uint64
+	mask uint64
+}
+
+func newSpscBuf(size uint64) *spscBuf {
+	return &spscBuf{buf: GetBytes(int(size)), size: size, mask: size - 1}
+}
+
+// roundPow2 rounds size up to a power of two.
+func roundPow2(size int) uint64 {
+	if size < 1 {
+		size = 1
+	}
+	return 1 << uint(bits.Len(uint(size-1)))
+}
+
+// NewSpscRingBuffer returns a new SpscRingBuffer whose capacity is size rounded up to a power of two.
+// The underlying buffer is taken from the byte pool, call Release to give it back.
+func NewSpscRingBuffer(size int) *SpscRingBuffer {
+	return NewGrowableSpscRingBuffer(size, size)
+}
+
+// NewGrowableSpscRingBuffer returns a new SpscRingBuffer whose buffer starts with size
+// and grows up to maxSize, both rounded up to a power of two.
+func NewGrowableSpscRingBuffer(size, maxSize int) *SpscRingBuffer {
+	if maxSize < size {
+		maxSize = size
+	}
+	return &SpscRingBuffer{
+		b:       unsafe.Pointer(newSpscBuf(roundPow2(size))),
+		maxSize: roundPow2(maxSize),
+	}
+}
+
+// load returns the current buffer. The consumer must load it after the write position,
+// so that it sees the buffer the data up to that position was written to.
+func (r *SpscRingBuffer) load() *spscBuf {
+	return (*spscBuf)(atomic.LoadPointer(&r.b))
+}
+
+// grow replaces b, the current buffer, by one that can hold need bytes, limited to maxSize.
+// It is called by the producer, wp is the write position.
+func (r *SpscRingBuffer) grow(b *spscBuf, wp, need uint64) *spscBuf {
+	if need <= b.size || b.size >= r.maxSize {
+		return b
+	}
+
+	size := b.size
+	for size < need {
+		size <<= 1
+	}
+	if size > r.maxSize {
+		size = r.maxSize
+	}
+
+	nb := newSpscBuf(size)
+	for p := atomic.LoadUint64(&r.r); p < wp; {
+		oi, ni := p&b.mask, p&nb.mask
+		n := wp - p
+		if b.size-oi < n {
+			n = b.size - oi
+		}
+		if nb.size-ni < n {
+			n = nb.size - ni
+		}
+		copy(nb.buf[ni:ni+n], b.buf[oi:oi+n])
+		p += n
+	}
+	atomic.StorePointer(&r.b, unsafe.Pointer(nb))
+
+	if atomic.LoadUint64(&r.r) == wp {
+		// the consumer holds no data of the old buffer any more
+		PutBytes(b.buf)
+	}
+	return nb
+}
+
+// Release returns the underlying buffer to the byte pool. The SpscRingBuffer must not be used afterwards.
+func (r *SpscRingBuffer) Release() {
+	PutBytes(r.load().buf)
+	atomic.StorePointer(&r.b, unsafe.Pointer(&spscBuf{}))
+	atomic.StoreUint64(&r.r, 0)
+	atomic.StoreUint64(&r.w, 0)
+}
+
+// Read reads up to len(p) bytes into p. It returns ErrIsEmpty if there is no data available.
+func (r *SpscRingBuffer) Read(p []byte) (n int, err error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	head, tail := r.Peek(len(p))
+	if len(head) == 0 {
+		return 0, ErrIsEmpty
+	}
+	n = copy(p, head)
+	n += copy(p[n:], tail)
+	atomic.StoreUint64(&r.r, atomic.LoadUint64(&r.r)+uint64(n))
+	return n, nil
+}
+
+// ReadByte reads and returns the next byte from the input or ErrIsEmpty.
+func (r *SpscRingBuffer) ReadByte() (b byte, err error) {
+	rp := atomic.LoadUint64(&r.r)
+	if atomic.LoadUint64(&r.w) == rp {
+		return 0, ErrIsEmpty
+	}
+	buf := r.load()
+	b = buf.buf[rp&buf.mask]
+	atomic.StoreUint64(&r.r, rp+1)
+	return b, nil
+}
+
+// Write writes len(p) bytes from p to the underlying buf, growing the buffer when needed.
+// It returns ErrIsFull if there is no free space, and ErrTooManyDataToWrite if only part of p fits.
+func (r *SpscRingBuffer) Write(p []byte) (n int, err error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	wp := atomic.LoadUint64(&r.w)
+	b := r.load()
+	length := wp - atomic.LoadUint64(&r.r)
+	if uint64(len(p)) > b.size-length {
+		b = r.grow(b, wp, length+uint64(len(p)))
+	}
+	free := b.size - (wp - atomic.LoadUint64(&r.r))
+	if free == 0 {
+		return 0, ErrIsFull
+	}
+	if uint64(len(p)) > free {
+		err = ErrTooManyDataToWrite
+		p = p[:free]
+	}
+
+	wi := wp & b.mask
+	n = copy(b.buf[wi:b.size], p)
+	if n < len(p) {
+		n += copy(b.buf, p[n:])
+	}
+	atomic.StoreUint64(&r.w, wp+uint64(n))
+	return n, err
+}
+
+// WriteByte writes one byte into buffer, and returns ErrIsFull if buffer is full.
+func (r *SpscRingBuffer) WriteByte(c byte) error {
+	wp := atomic.LoadUint64(&r.w)
+	b := r.load()
+	if wp-atomic.LoadUint64(&r.r) == b.size {
+		b = r.grow(b, wp, b.size+1)
+	}
+	if wp-atomic.LoadUint64(&r.r) == b.size {
+		return ErrIsFull
+	}
+	b.buf[wp&b.mask] = c
+	atomic.StoreUint64(&r.w, wp+1)
+	return nil
+}
+
+// WriteString writes the contents of the string s to buffer, which accepts a slice of bytes.
+func (r *SpscRingBuffer) WriteString(s string) (n int, err error) {
+	x := (*[2]uintptr)(unsafe.Pointer(&s))
+	h := [3]uintptr{x[0], x[1], x[1]}
+	buf := *(*[]byte)(unsafe.Pointer(&h))
+	return r.Write(buf)
+}
+
+// Peek returns up to n available read bytes without copying and without moving the read pointer.
+// The data may wrap around the end of the buffer, so it is returned as two slices, head is followed by tail.
+// Both slices are only valid until the next Read, Discard or Reset.
+func (r *SpscRingBuffer) Peek(n int) (head []byte, tail []byte) {
+	if n <= 0 {
+		return nil, nil
+	}
+
+	rp := atomic.LoadUint64(&r.r)
+	avail := atomic.LoadUint64(&r.w) - rp
+	if avail == 0 {
+		return nil, nil
+	}
+	if uint64(n) > avail {
+		n = int(avail)
+	}
+
+	b := r.load()
+	ri := rp & b.mask
+	if ri+uint64(n) <= b.size {
+		return b.buf[ri : ri+uint64(n)], nil
+	}
+	return b.buf[ri:b.size], b.buf[0 : uint64(n)-(b.size-ri)]
+}
+
+// Discard skips the next n available read bytes. It returns the number of bytes discarded.
+func (r *SpscRingBuffer) Discard(n int) int {
+	if n <= 0 {
+		return 0
+	}
+
+	rp := atomic.LoadUint64(&r.r)
+	avail := atomic.LoadUint64(&r.w) - rp
+	if uint64(n) > avail {
+		n = int(avail)
+	}
+	atomic.StoreUint64(&r.r, rp+uint64(n))
+	return n
+}
+
+// Fill calls rd.Read once, reading directly into the contiguous free space after the write pointer.
+// If the buffer is full it grows first, and ErrIsFull is returned when it has already reached its maximum size.
+func (r *SpscRingBuffer) Fill(rd io.Reader) (n int, err error) {
+	wp := atomic.LoadUint64(&r.w)
+	b := r.load()
+	if wp-atomic.LoadUint64(&r.r) == b.size {
+		b = r.grow(b, wp, b.size+1)
+	}
+	free := b.size - (wp - atomic.LoadUint64(&r.r))
+	if free == 0 {
+		return 0, ErrIsFull
+	}
+
+	wi := wp & b.mask
+	if wi+free > b.size {
+		free = b.size - wi
+	}
+	n, err = rd.Read(b.buf[wi : wi+free])
+	if n <= 0 {
+		return 0, err
+	}
+	atomic.StoreUint64(&r.w, wp+uint64(n))
+	return n, err
+}
+
+// ReadFrom implements io.ReaderFrom. It reads data from rd into the buffer until EOF or an error occurs,
+// growing the buffer when needed. It returns ErrIsFull if the buffer reaches its maximum size before EOF.
+func (r *SpscRingBuffer) ReadFrom(rd io.Reader) (n int64, err error) {
+	for {
+		m, e := r.Fill(rd)
+		n += int64(m)
+		if e == io.EOF {
+			return n, nil
+		}
+		if e != nil {
+			return n, e
+		}
+	}
+}
+
+// WriteTo implements io.WriterTo. It writes all available read bytes to w without an intermediate copy
+// and moves the read pointer past the bytes written.
+func (r *SpscRingBuffer) WriteTo(w io.Writer) (n int64, err error) {
+	head, tail := r.Peek(r.Length())
+	for _, p := range [][]byte{head, tail} {
+		if len(p) == 0 {
+			continue
+		}
+		m, e := w.Write(p)
+		n += int64(m)
+		if e == nil && m < len(p) {
+			e = io.ErrShortWrite
+		}
+		if e != nil {
+			r.Discard(int(n))
+			return n, e
+		}
+	}
+	r.Discard(int(n))
+	return n, nil
+}
+
+// Bytes returns a copy of all available read bytes. It does not move the read pointer.
+func (r *SpscRingBuffer) Bytes() []byte {
+	head, tail := r.Peek(r.Length())
+	if len(head) == 0 {
+		return nil
+	}
+	buf := make([]byte, len(head)+len(tail))
+	copy(buf, head)
+	copy(buf[len(head):], tail)
+	return buf
+}
+
+// Length return the length of available read bytes.
+func (r *SpscRingBuffer) Length() int {
+	rp := atomic.LoadUint64(&r.r)
+	return int(atomic.LoadUint64(&r.w) - rp)
+}
+
+// Free returns the length of available bytes to write, not counting the room the buffer may still grow.
+func (r *SpscRingBuffer) Free() int {
+	return r.Capacity() - r.Length()
+}
+
+// Capacity returns the size of the underlying buffer.
+func (r *SpscRingBuffer) Capacity() int {
+	return int(r.load().size)
+}
+
+// MaxCapacity returns the size the underlying buffer may grow up to.
+func (r *SpscRingBuffer) MaxCapacity() int {
+	return int(r.maxSize)
+}
+
+// IsFull returns this ringbuffer is full.
+func (r *SpscRingBuffer) IsFull() bool {
+	return r.Length() == r.Capacity()
+}
+
+// IsEmpty returns this ringbuffer is empty.
+func (r *SpscRingBuffer) IsEmpty() bool {
+	return r.Length() == 0
+}
+
+// Reset discards all available read bytes. It is called by the consumer.
+func (r *SpscRingBuffer) Reset() {
+	atomic.StoreUint64(&r.r, atomic.LoadUint64(&r.w))
+}
@@ -1,18 +1,38 @@
 package tools
 
 import (
-	"context"
 	"github.com/golang/glog"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+/**
+ * 空闲类型
+ */
+const (
+	IdleReader = 1 // 读空闲，超过读空闲时间未收到数据
+	IdleWriter = 2 // 写空闲，超过写空闲时间未发送数据
+	IdleAll    = 3 // 读写空闲，超过读写空闲时间既未收到也未发送数据
+)
+
+/**
+ * @brief: 空闲检测，基于共享时间轮
+ * 每种空闲类型只在时间轮上挂一个截止时间，到期时再根据最后活动时间判断，有活动则顺延，
+ * Tick/TickWrite只做原子写入
+ */
 type TimeoutCheck struct {
-	timer        *time.Ticker  // 定时器
+	wheel        *TimingWheel  // 时间轮
 	interval     time.Duration // 间隔
-	timeout      time.Duration // 超时时间长度
-	lastTickTime time.Time     // 最后tick 时间
-	ctx       context.Context	// 上下文
-	cancel    context.CancelFunc // cancel 函数
+	timeout      time.Duration // 超时时间长度，即读空闲时间
+	writeTimeout time.Duration // 写空闲时间，<=0不检测
+	allTimeout   time.Duration // 读写空闲时间，<=0不检测
+	lastTickTime int64         // 最后tick 时间，即最后接收数据时间，UnixNano，原子操作
+	lastWriteTime int64        // 最后发送数据时间，UnixNano，原子操作
+	fired        [IdleAll + 1]int64  // 各空闲类型最后一次回调时间，只在时间轮协程中访问
+	timers       [IdleAll + 1]*Timer // 各空闲类型的定时任务
+	cancelled    bool          // 是否已取消
+	mu           sync.Mutex
 }
 
 /**
@@ -29,33 +49,59 @@ func NewTimeoutCheck(interval, timeout time.Duration)*TimeoutCheck {
 	}
 
 	tc := &TimeoutCheck{}
+	tc.wheel = DefaultTimingWheel()
 	tc.interval = interval
 	tc.timeout = timeout
-
-	tc.ctx, tc.cancel = context.WithCancel(context.Background())
+	now := time.Now().UnixNano()
+	tc.lastTickTime = now
+	tc.lastWriteTime = now
 
 	return tc
 }
 
+/**
+ * @brief: 设置写空闲、读写空闲时间，需要在Check之前调用
+ * @param1 writeTimeout: 写空闲时间，<=0不检测
+ * @param2 allTimeout: 读写空闲时间，<=0不检测
+ */
+func (tc *TimeoutCheck)SetIdle(writeTimeout, allTimeout time.Duration){
+	tc.writeTimeout = writeTimeout
+	tc.allTimeout = allTimeout
+}
+
 /**
  * @brief: 取消
  */
 func (tc *TimeoutCheck)Cancel(){
-	if tc.cancel != nil{
-		tc.cancel()
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	tc.cancelled = true
+	for i := range tc.timers {
+		if tc.timers[i] != nil {
+			tc.timers[i].Stop()
+			tc.timers[i] = nil
+		}
 	}
 }
 
 /**
- * @brief: 设置最后tick时间
+ * @brief: 设置最后tick时间，接收到数据时调用
  */
 func (tc *TimeoutCheck)Tick(){
-	tc.lastTickTime = time.Now()
+	atomic.StoreInt64(&tc.lastTickTime, time.Now().UnixNano())
 }
 
 /**
- * @brief: 检测是否过期
- * @param1 cb: 回调函数
+ * @brief: 设置最后发送数据时间
+ */
+func (tc *TimeoutCheck)TickWrite(){
+	atomic.StoreInt64(&tc.lastWriteTime, time.Now().UnixNano())
+}
+
+/**
+ * @brief: 检测是否过期，读空闲时回调并结束检测
+ * @param1 cb: 回调函数，在时间轮协程中执行，不能阻塞
  */
 func (tc *TimeoutCheck)Check(cb func(bool)){
 	if cb == nil{
@@ -63,30 +109,101 @@ func (tc *TimeoutCheck)Check(cb func(bool)){
 		return
 	}
 
-	go func(){
-		if int(tc.interval) <= 0{
-			glog.Infoln("时间间隔小于等于0，不启动超时检测定时器")
-			return
+	tc.CheckIdle(func(kind int) bool {
+		if kind != IdleReader {
+			return true
 		}
+		cb(true)
+		return false
+	})
+}
 
-		tc.timer = time.NewTicker(tc.interval)
-		defer func(){
-			tc.timer.Stop()
-		}()
-
-		for{
-			select {
-			case <-tc.ctx.Done():
-				glog.Infoln( "Check ctx.Done")
-				return
-			case <-tc.timer.C:
-				now := time.Now()
-				if now.Sub(tc.lastTickTime) > tc.timeout{
-					glog.Errorln("heartbeat timeout exit", now.Format("2006-01-02 15:04:05"), tc.lastTickTime.Format("2006-01-02 15:04:05"))
-					cb(true)
-					return
-				}
-			}
+/**
+ * @brief: 空闲检测，空闲持续期间每经过一个对应空闲时间回调一次
+ * @param1 cb: 回调函数，参数为空闲类型，返回false结束检测；在时间轮协程中执行，不能阻塞
+ */
+func (tc *TimeoutCheck)CheckIdle(cb func(int)bool){
+	if cb == nil{
+		glog.Errorln("TimeoutCheck.CheckIdle参数为nil")
+		return
+	}
+
+	for kind := IdleReader; kind <= IdleAll; kind++ {
+		if t := tc.idleTimeout(kind); t > 0 {
+			tc.schedule(kind, t, cb)
 		}
-	}()
+	}
+}
+
+/**
+ * @brief: 空闲类型对应的空闲时间
+ */
+func (tc *TimeoutCheck)idleTimeout(kind int)time.Duration{
+	switch kind {
+	case IdleReader:
+		return tc.timeout
+	case IdleWriter:
+		return tc.writeTimeout
+	case IdleAll:
+		return tc.allTimeout
+	}
+	return 0
+}
+
+/**
+ * @brief: 空闲类型对应的最后活动时间
+ */
+func (tc *TimeoutCheck)lastActive(kind int)int64{
+	read := atomic.LoadInt64(&tc.lastTickTime)
+	switch kind {
+	case IdleReader:
+		return read
+	case IdleWriter:
+		return atomic.LoadInt64(&tc.lastWriteTime)
+	}
+	if write := atomic.LoadInt64(&tc.lastWriteTime); write > read {
+		return write
+	}
+	return read
+}
+
+/**
+ * @brief: 在时间轮上挂空闲截止时间
+ */
+func (tc *TimeoutCheck)schedule(kind int, d time.Duration, cb func(int)bool){
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	if tc.cancelled {
+		return
+	}
+	tc.timers[kind] = tc.wheel.AfterFunc(d, func() {
+		tc.expire(kind, cb)
+	})
+}
+
+/**
+ * @brief: 截止时间到期，期间有活动则顺延，否则回调
+ */
+func (tc *TimeoutCheck)expire(kind int, cb func(int)bool){
+	timeout := tc.idleTimeout(kind)
+	now := time.Now().UnixNano()
+	since := tc.lastActive(kind)
+	if tc.fired[kind] > since {
+		since = tc.fired[kind]
+	}
+	if remain := timeout - time.Duration(now - since); remain > 0 {
+		tc.schedule(kind, remain, cb)
+		return
+	}
+
+	tc.fired[kind] = now
+	if kind == IdleReader {
+		glog.Errorln("heartbeat timeout", time.Unix(0, now).Format("2006-01-02 15:04:05"), time.Unix(0, since).Format("2006-01-02 15:04:05"))
+	}
+	if !cb(kind) {
+		tc.Cancel()
+		return
+	}
+	tc.schedule(kind, timeout, cb)
 }
@@ -0,0 +1,254 @@
+package tools
+
+import (
+	"context"
+	"github.com/golang/glog"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultWheelTick  = 50 * time.Millisecond // 默认时间轮精度
+	DefaultWheelSlots = 1024                  // 默认时间轮槽数
+)
+
+var (
+	defaultWheel     *TimingWheel
+	defaultWheelOnce sync.Once
+)
+
+/**
+ * @brief: 获取全局共享的时间轮，第一次调用时启动
+ */
+func DefaultTimingWheel()*TimingWheel{
+	defaultWheelOnce.Do(func() {
+		defaultWheel = NewTimingWheel(DefaultWheelTick, DefaultWheelSlots)
+		defaultWheel.Start()
+	})
+	return defaultWheel
+}
+
+/**
+ * @brief: 哈希时间轮
+ * 定时任务按到期tick哈希到槽中，所有定时任务共用一个推进协程，超过一圈的任务在经过对应槽时跳过，直到到期；
+ * 到期回调在推进协程中串行执行，不能阻塞，耗时操作需要自行启动协程
+ */
+type TimingWheel struct {
+	tick    time.Duration      // 精度
+	slots   []timerList        // 槽
+	current uint64             // 当前已处理到的tick
+	start   time.Time          // 启动时间
+	mu      sync.Mutex
+	ctx     context.Context    // 上下文
+	cancel  context.CancelFunc // cancel 函数
+}
+
+/**
+ * @brief: 定时任务
+ */
+type Timer struct {
+	wheel  *TimingWheel
+	at     uint64        // 到期tick
+	period uint64        // 周期tick数，0表示一次性任务
+	f      func()        // 回调
+	list   *timerList    // 所在槽，为nil表示不在时间轮中
+	prev   *Timer
+	next   *Timer
+}
+
+/**
+ * @brief: 槽内定时任务双向链表
+ */
+type timerList struct {
+	head *Timer
+}
+
+/**
+ * @brief: 创建时间轮
+ * @param1 tick: 精度
+ * @param2 slots: 槽数
+ */
+func NewTimingWheel(tick time.Duration, slots int)*TimingWheel{
+	if tick <= 0 {
+		tick = DefaultWheelTick
+	}
+	if slots <= 0 {
+		slots = DefaultWheelSlots
+	}
+
+	tw := &TimingWheel{
+		tick:  tick,
+		slots: make([]timerList, slots),
+		start: time.Now(),
+	}
+	tw.ctx, tw.cancel = context.WithCancel(context.Background())
+
+	return tw
+}
+
+/**
+ * @brief: 启动推进协程
+ */
+func (tw *TimingWheel)Start(){
+	go func() {
+		ticker := time.NewTicker(tw.tick)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-tw.ctx.Done():
+				return
+			case now := <-ticker.C:
+				// 按实际经过的时间推进，ticker丢失的tick一并处理
+				tw.advance(uint64(now.Sub(tw.start) / tw.tick))
+			}
+		}
+	}()
+}
+
+/**
+ * @brief: 停止推进协程，未到期的任务不再执行
+ */
+func (tw *TimingWheel)Stop(){
+	if tw.cancel != nil {
+		tw.cancel()
+	}
+}
+
+/**
+ * @brief: 延迟执行一次
+ * @param1 d: 延迟时间，不足一个tick按一个tick计算
+ * @param2 f: 回调，在推进协程中执行
+ */
+func (tw *TimingWheel)AfterFunc(d time.Duration, f func())*Timer{
+	t := &Timer{wheel: tw, f: f}
+	tw.mu.Lock()
+	t.at = tw.current + tw.ticks(d)
+	tw.add(t)
+	tw.mu.Unlock()
+	return t
+}
+
+/**
+ * @brief: 周期执行，直到Stop
+ * @param1 d: 周期，不足一个tick按一个tick计算
+ * @param2 f: 回调，在推进协程中执行
+ */
+func (tw *TimingWheel)Every(d time.Duration, f func())*Timer{
+	t := &Timer{wheel: tw, f: f, period: tw.ticks(d)}
+	tw.mu.Lock()
+	t.at = tw.current + t.period
+	tw.add(t)
+	tw.mu.Unlock()
+	return t
+}
+
+/**
+ * @brief: 停止定时任务
+ * @return1: 任务是否还在等待执行
+ */
+func (t *Timer)Stop()bool{
+	tw := t.wheel
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	t.period = 0
+	if t.list == nil {
+		return false
+	}
+	t.list.remove(t)
+	return true
+}
+
+/**
+ * @brief: 时间转换为tick数，至少为1
+ */
+func (tw *TimingWheel)ticks(d time.Duration)uint64{
+	n := uint64((d + tw.tick - 1) / tw.tick)
+	if n == 0 {
+		n = 1
+	}
+	return n
+}
+
+/**
+ * @brief: 加入对应槽，需要持有锁
+ */
+func (tw *TimingWheel)add(t *Timer){
+	tw.slots[t.at % uint64(len(tw.slots))].push(t)
+}
+
+/**
+ * @brief: 推进到指定tick，依次处理经过的槽
+ */
+func (tw *TimingWheel)advance(target uint64){
+	var expired []*Timer
+	for {
+		tw.mu.Lock()
+		if tw.current >= target {
+			tw.mu.Unlock()
+			return
+		}
+		tw.current++
+		l := &tw.slots[tw.current % uint64(len(tw.slots))]
+		expired = expired[:0]
+		for t := l.head; t != nil; {
+			next := t.next
+			if t.at <= tw.current {
+				l.remove(t)
+				expired = append(expired, t)
+			}
+			t = next
+		}
+		tw.mu.Unlock()
+
+		for _, t := range expired {
+			tw.run(t)
+		}
+	}
+}
+
+/**
+ * @brief: 执行到期任务，周期任务重新加入
+ */
+func (tw *TimingWheel)run(t *Timer){
+	func() {
+		defer func() {
+			if x := recover(); x != nil {
+				glog.Errorln("TimingWheel.run recover:", x)
+			}
+		}()
+		t.f()
+	}()
+
+	tw.mu.Lock()
+	if t.period > 0 && t.list == nil {
+		t.at = tw.current + t.period
+		tw.add(t)
+	}
+	tw.mu.Unlock()
+}
+
+func (l *timerList)push(t *Timer){
+	t.list = l
+	t.prev = nil
+	t.next = l.head
+	if l.head != nil {
+		l.head.prev = t
+	}
+	l.head = t
+}
+
+func (l *timerList)remove(t *Timer){
+	if t.prev != nil {
+		t.prev.next = t.next
+	} else {
+		l.head = t.next
+	}
+	if t.next != nil {
+		t.next.prev = t.prev
+	}
+	t.list = nil
+	t.prev = nil
+	t.next = nil
+}
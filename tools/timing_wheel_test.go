@@ -0,0 +1,236 @@
+package tools
+
+import (
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// the wheel is driven with advance directly, without the ticker goroutine
+func newTestWheel() *TimingWheel {
+	return NewTimingWheel(10*time.Millisecond, 8)
+}
+
+func TestTimingWheelAfterFunc(t *testing.T) {
+	tw := newTestWheel()
+	var fired int32
+	tw.AfterFunc(30*time.Millisecond, func() { atomic.AddInt32(&fired, 1) })
+
+	tw.advance(2)
+	if atomic.LoadInt32(&fired) != 0 {
+		t.Fatal("fired early")
+	}
+	tw.advance(3)
+	if atomic.LoadInt32(&fired) != 1 {
+		t.Fatal("not fired at deadline")
+	}
+	tw.advance(20)
+	if atomic.LoadInt32(&fired) != 1 {
+		t.Fatal("one-shot timer fired again")
+	}
+}
+
+func TestTimingWheelShortDelay(t *testing.T) {
+	tw := newTestWheel()
+	var fired int32
+	// less than one tick is rounded up to one tick
+	tw.AfterFunc(time.Millisecond, func() { atomic.AddInt32(&fired, 1) })
+	tw.AfterFunc(0, func() { atomic.AddInt32(&fired, 1) })
+
+	tw.advance(1)
+	if atomic.LoadInt32(&fired) != 2 {
+		t.Fatal(fired)
+	}
+}
+
+func TestTimingWheelLaps(t *testing.T) {
+	tw := newTestWheel()
+	var fired int32
+	// 10 ticks on an 8 slot wheel, slot 2 is passed once before the deadline
+	tw.AfterFunc(100*time.Millisecond, func() { atomic.AddInt32(&fired, 1) })
+	// exactly two laps, the timer shares slot 0 with the current tick
+	tw.AfterFunc(160*time.Millisecond, func() { atomic.AddInt32(&fired, 10) })
+
+	tw.advance(9)
+	if atomic.LoadInt32(&fired) != 0 {
+		t.Fatal("fired before completing its lap")
+	}
+	tw.advance(10)
+	if atomic.LoadInt32(&fired) != 1 {
+		t.Fatal(fired)
+	}
+	tw.advance(15)
+	if atomic.LoadInt32(&fired) != 1 {
+		t.Fatal(fired)
+	}
+	tw.advance(16)
+	if atomic.LoadInt32(&fired) != 11 {
+		t.Fatal(fired)
+	}
+}
+
+func TestTimingWheelEvery(t *testing.T) {
+	tw := newTestWheel()
+	var fired []uint64
+	tw.Every(20*time.Millisecond, func() { fired = append(fired, tw.current) })
+
+	tw.advance(11)
+	want := []uint64{2, 4, 6, 8, 10}
+	if len(fired) != len(want) {
+		t.Fatal(fired)
+	}
+	for i := range want {
+		if fired[i] != want[i] {
+			t.Fatal(fired)
+		}
+	}
+
+	// a period longer than the wheel keeps its period across laps
+	fired = fired[:0]
+	tw2 := newTestWheel()
+	tw2.Every(120*time.Millisecond, func() { fired = append(fired, tw2.current) })
+	tw2.advance(40)
+	if len(fired) != 3 || fired[0] != 12 || fired[1] != 24 || fired[2] != 36 {
+		t.Fatal(fired)
+	}
+}
+
+func TestTimingWheelStop(t *testing.T) {
+	tw := newTestWheel()
+	var fired int32
+	timer := tw.AfterFunc(30*time.Millisecond, func() { atomic.AddInt32(&fired, 1) })
+	if !timer.Stop() {
+		t.Fatal("Stop of a pending timer returned false")
+	}
+	if timer.Stop() {
+		t.Fatal("second Stop returned true")
+	}
+	tw.advance(10)
+	if atomic.LoadInt32(&fired) != 0 {
+		t.Fatal("stopped timer fired")
+	}
+
+	fired = 0
+	after := tw.AfterFunc(10*time.Millisecond, func() {})
+	tw.advance(11)
+	if after.Stop() {
+		t.Fatal("Stop of an expired timer returned true")
+	}
+
+	// stopping a periodic timer from its own callback
+	var every *Timer
+	every = tw.Every(10*time.Millisecond, func() {
+		if atomic.AddInt32(&fired, 1) == 3 {
+			every.Stop()
+		}
+	})
+	tw.advance(30)
+	if atomic.LoadInt32(&fired) != 3 {
+		t.Fatal(fired)
+	}
+}
+
+func TestTimingWheelRecover(t *testing.T) {
+	tw := newTestWheel()
+	var fired int32
+	tw.Every(10*time.Millisecond, func() {
+		atomic.AddInt32(&fired, 1)
+		panic("test")
+	})
+	tw.advance(3)
+	if atomic.LoadInt32(&fired) != 3 {
+		t.Fatal("periodic timer not rescheduled after panic", fired)
+	}
+}
+
+func TestTimingWheelStart(t *testing.T) {
+	tw := NewTimingWheel(5*time.Millisecond, 16)
+	tw.Start()
+	defer tw.Stop()
+
+	done := make(chan time.Time, 1)
+	begin := time.Now()
+	tw.AfterFunc(30*time.Millisecond, func() { done <- time.Now() })
+	select {
+	case at := <-done:
+		if at.Sub(begin) < 25*time.Millisecond {
+			t.Fatal("fired too early", at.Sub(begin))
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("not fired")
+	}
+}
+
+const (
+	benchConns    = 100000
+	benchInterval = 100 * time.Millisecond
+	benchWindow   = time.Second
+)
+
+// benchmarkIdleConns simulates the idle check of benchConns connections for benchWindow
+// and reports the goroutines in use and the process CPU time spent
+func benchmarkIdleConns(b *testing.B, start func(check func()) (stop func())) {
+	var checks int64
+	check := func() { atomic.AddInt64(&checks, 1) }
+
+	for i := 0; i < b.N; i++ {
+		base := runtime.NumGoroutine()
+		stop := start(check)
+		atomic.StoreInt64(&checks, 0)
+		cpu := cpuTime()
+		time.Sleep(benchWindow)
+		cpu = cpuTime() - cpu
+		n := atomic.LoadInt64(&checks)
+		goroutines := runtime.NumGoroutine() - base
+		stop()
+
+		b.ReportMetric(float64(goroutines), "goroutines")
+		b.ReportMetric(float64(cpu)/float64(time.Millisecond), "cpu-ms/s")
+		b.ReportMetric(float64(n), "checks/s")
+	}
+}
+
+// one shared wheel for all connections
+func BenchmarkIdleConnsTimingWheel(b *testing.B) {
+	benchmarkIdleConns(b, func(check func()) func() {
+		tw := NewTimingWheel(DefaultWheelTick, DefaultWheelSlots)
+		tw.Start()
+		timers := make([]*Timer, benchConns)
+		for i := range timers {
+			timers[i] = tw.Every(benchInterval, check)
+		}
+		return func() {
+			for _, t := range timers {
+				t.Stop()
+			}
+			tw.Stop()
+		}
+	})
+}
+
+// one goroutine and time.Ticker per connection, as TimeoutCheck did before the timing wheel
+func BenchmarkIdleConnsTicker(b *testing.B) {
+	benchmarkIdleConns(b, func(check func()) func() {
+		done := make(chan struct{})
+		for i := 0; i < benchConns; i++ {
+			go func() {
+				ticker := time.NewTicker(benchInterval)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-done:
+						return
+					case <-ticker.C:
+						check()
+					}
+				}
+			}()
+		}
+		// let the goroutines start their tickers
+		for runtime.NumGoroutine() < benchConns {
+			runtime.Gosched()
+		}
+		return func() { close(done) }
+	})
+}
@@ -0,0 +1,239 @@
+package tools
+
+import (
+	"context"
+	"github.com/golang/glog"
+	"sync"
+	"sync/atomic"
+)
+
+// 每次调度处理单个任务队列的最大任务数，避免单个队列长期占用工作协程
+const taskQueueBatch = 64
+
+/**
+ * @brief: 工作协程池
+ * 任务按队列提交，同一队列内的任务严格按顺序、串行处理，不同队列之间并行处理
+ * 待调度的任务队列放在就绪列表中，每个任务队列最多在列表中出现一次，调度不会阻塞提交方
+ */
+type WorkerPool struct {
+	workers int               // 工作协程数
+	mu      sync.Mutex        // 就绪列表锁
+	ready   []*TaskQueue      // 待调度的任务队列
+	notify  chan struct{}     // 通知空闲工作协程有新的任务队列
+	ctx     context.Context   // 上下文
+	cancel  context.CancelFunc // cancel 函数
+}
+
+/**
+ * @brief: 创建工作协程池
+ * @param1 workers: 工作协程数
+ */
+func NewWorkerPool(workers int)*WorkerPool{
+	if workers <= 0 {
+		workers = 1
+	}
+
+	wp := &WorkerPool{
+		workers: workers,
+		notify:  make(chan struct{}, workers),
+	}
+	wp.ctx, wp.cancel = context.WithCancel(context.Background())
+
+	return wp
+}
+
+/**
+ * @brief: 启动工作协程
+ */
+func (wp *WorkerPool)Start(){
+	for i := 0; i < wp.workers; i++ {
+		go func() {
+			for {
+				if q := wp.pop(); q != nil {
+					wp.run(q)
+					continue
+				}
+				select {
+				case <-wp.ctx.Done():
+					return
+				case <-wp.notify:
+				}
+			}
+		}()
+	}
+}
+
+/**
+ * @brief: 停止工作协程，未处理的任务不再处理
+ */
+func (wp *WorkerPool)Stop(){
+	if wp.cancel != nil {
+		wp.cancel()
+	}
+}
+
+/**
+ * @brief: 创建任务队列
+ * @param1 size: 队列容量
+ * @param2 handler: 任务处理函数，同一队列的任务串行调用
+ * @param3 release: 队列关闭后被丢弃的任务的释放函数，可以为nil
+ */
+func (wp *WorkerPool)NewTaskQueue(size int, handler, release func(interface{}))*TaskQueue{
+	if size <= 0 {
+		size = 1000
+	}
+
+	return &TaskQueue{
+		pool:    wp,
+		items:   make(chan interface{}, size),
+		handler: handler,
+		release: release,
+	}
+}
+
+/**
+ * @brief: 任务队列加入就绪列表并唤醒一个空闲工作协程，不阻塞
+ */
+func (wp *WorkerPool)push(q *TaskQueue){
+	wp.mu.Lock()
+	wp.ready = append(wp.ready, q)
+	wp.mu.Unlock()
+
+	select {
+	case wp.notify <- struct{}{}:
+	default:
+		// 已有足够的通知，工作协程处理完当前队列后会继续取就绪列表
+	}
+}
+
+/**
+ * @brief: 取出最早就绪的任务队列，没有时返回nil
+ */
+func (wp *WorkerPool)pop()*TaskQueue{
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+
+	if len(wp.ready) == 0 {
+		return nil
+	}
+	q := wp.ready[0]
+	wp.ready[0] = nil
+	wp.ready = wp.ready[1:]
+	return q
+}
+
+/**
+ * @brief: 处理一个任务队列，还有剩余任务时重新加入就绪列表末尾，让其他队列先处理
+ */
+func (wp *WorkerPool)run(q *TaskQueue){
+	if wp.ctx.Err() != nil {
+		return
+	}
+	q.drain()
+
+	atomic.StoreInt32(&q.scheduled, 0)
+	if len(q.items) > 0 && atomic.CompareAndSwapInt32(&q.scheduled, 0, 1) {
+		wp.push(q)
+	}
+}
+
+/**
+ * @brief: 任务队列，属于某个工作协程池
+ */
+type TaskQueue struct {
+	pool      *WorkerPool              // 所属协程池
+	items     chan interface{}         // 任务
+	handler   func(interface{})        // 处理函数
+	release   func(interface{})        // 丢弃任务的释放函数
+	scheduled int32                    // 是否已提交调度
+	closed    int32                    // 是否已关闭
+}
+
+/**
+ * @brief: 提交任务
+ * @param1 item: 任务
+ * @param2 block: 队列已满时是否阻塞等待
+ * @return1: 是否提交成功，队列已满(非阻塞)或已关闭时返回false，此时任务所有权仍属于调用方
+ */
+func (q *TaskQueue)Push(item interface{}, block bool)bool{
+	if atomic.LoadInt32(&q.closed) == 1 {
+		return false
+	}
+
+	if block {
+		select {
+		case q.items <- item:
+		case <-q.pool.ctx.Done():
+			return false
+		}
+	} else {
+		select {
+		case q.items <- item:
+		default:
+			q.schedule()
+			return false
+		}
+	}
+
+	q.schedule()
+	return true
+}
+
+/**
+ * @brief: 关闭队列，剩余任务不再处理，交给release释放
+ */
+func (q *TaskQueue)Close(){
+	if atomic.CompareAndSwapInt32(&q.closed, 0, 1) {
+		q.schedule()
+	}
+}
+
+/**
+ * @brief: 当前队列中的任务数
+ */
+func (q *TaskQueue)Len()int{
+	return len(q.items)
+}
+
+/**
+ * @brief: 提交到协程池调度，不阻塞
+ */
+func (q *TaskQueue)schedule(){
+	if !atomic.CompareAndSwapInt32(&q.scheduled, 0, 1) {
+		return
+	}
+	q.pool.push(q)
+}
+
+/**
+ * @brief: 处理队列中的任务，单次最多taskQueueBatch个
+ */
+func (q *TaskQueue)drain(){
+	for i := 0; i < taskQueueBatch; i++ {
+		select {
+		case item := <-q.items:
+			q.process(item)
+		default:
+			return
+		}
+	}
+}
+
+/**
+ * @brief: 处理单个任务，队列已关闭时只做释放
+ */
+func (q *TaskQueue)process(item interface{}){
+	defer func() {
+		if x := recover(); x != nil {
+			glog.Errorln("TaskQueue.process recover:", x)
+		}
+	}()
+
+	if atomic.LoadInt32(&q.closed) == 1 {
+		if q.release != nil {
+			q.release(item)
+		}
+		return
+	}
+	q.handler(item)
+}
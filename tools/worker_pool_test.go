@@ -0,0 +1,112 @@
+package tools
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWorkerPoolOrder(t *testing.T) {
+	wp := NewWorkerPool(4)
+	wp.Start()
+	defer wp.Stop()
+
+	const queues, items = 50, 200
+	var wg sync.WaitGroup
+	wg.Add(queues * items)
+	got := make([][]int, queues)
+	qs := make([]*TaskQueue, queues)
+	for i := range qs {
+		i := i
+		qs[i] = wp.NewTaskQueue(16, func(item interface{}) {
+			got[i] = append(got[i], item.(int))
+			wg.Done()
+		}, nil)
+	}
+	for j := 0; j < items; j++ {
+		for _, q := range qs {
+			if !q.Push(j, true) {
+				t.Fatal("Push failed")
+			}
+		}
+	}
+	wg.Wait()
+	for i, g := range got {
+		for j, v := range g {
+			if v != j {
+				t.Fatalf("queue %d: item %d = %d", i, j, v)
+			}
+		}
+	}
+}
+
+// with every worker busy and more ready queues than workers, a non-blocking Push
+// must return at once instead of waiting for a worker
+func TestWorkerPoolPushNonBlocking(t *testing.T) {
+	wp := NewWorkerPool(1)
+	wp.Start()
+	defer wp.Stop()
+
+	block := make(chan struct{})
+	var handled int32
+	handler := func(interface{}) {
+		<-block
+		atomic.AddInt32(&handled, 1)
+	}
+
+	const queues = 1000
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < queues; i++ {
+			q := wp.NewTaskQueue(1, handler, nil)
+			q.Push(i, false)
+			// the queue is full, this push is rejected
+			if q.Push(i, false) {
+				t.Error("Push on a full queue succeeded")
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("non-blocking Push blocked")
+	}
+
+	close(block)
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&handled) != queues {
+		if time.Now().After(deadline) {
+			t.Fatalf("handled %d of %d", atomic.LoadInt32(&handled), queues)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestTaskQueueClose(t *testing.T) {
+	wp := NewWorkerPool(1)
+	wp.Start()
+	defer wp.Stop()
+
+	block := make(chan struct{})
+	released := make(chan interface{}, 10)
+	q := wp.NewTaskQueue(10, func(interface{}) { <-block }, func(item interface{}) { released <- item })
+	for i := 0; i < 5; i++ {
+		q.Push(i, true)
+	}
+	q.Close()
+	close(block)
+	if q.Push(5, true) {
+		t.Fatal("Push after Close succeeded")
+	}
+
+	// the item being handled when Close was called is not released
+	for i := 0; i < 4; i++ {
+		select {
+		case <-released:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("released %d items", i)
+		}
+	}
+}